@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheMaxEntries is the max number of responses in a cache.
+	cacheMaxEntries = 1024
+	// cacheMaxEntrySize is the max size of a cached compressed body.
+	cacheMaxEntrySize = 1 << 20
+)
+
+// timeNow returns the current time, it's replaced by the tests.
+var timeNow = time.Now
+
+// responseCache caches the compressed responses, keyed by the request URL
+// and the encoding, so they don't need to be compressed again.
+type responseCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	expires    time.Time
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// cacheKey returns the key of the response to r encoded by enc. The host is
+// a part of it, the handler may serve multiple virtual hosts, whose URLs
+// have no host on the server side.
+func cacheKey(r *http.Request, enc EncodingType) string {
+	return string(enc) + " " + r.Host + " " + r.URL.String()
+}
+
+// cacheableRequest reports whether the response of r can be served from
+// or stored into the cache.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	// The conditional and range requests are left to the inner handler.
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match",
+		"If-Unmodified-Since", "If-Range", "Range"} {
+		if _, ok := r.Header[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !timeNow().Before(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e
+}
+
+// store caches the response to r if it's cacheable by its header.
+func (c *responseCache) store(r *http.Request, key string, statusCode int, header http.Header, body []byte) {
+	if statusCode != http.StatusOK {
+		return
+	}
+	if hasCredentials(r) && !sharedWithAuthorization(header) {
+		// https://tools.ietf.org/html/rfc7234#section-3.2
+		// The response to an authorized request is only shared if it
+		// says so, it's likely of the user.
+		return
+	}
+	now := timeNow()
+	ttl, ok := cacheTTL(header, now)
+	if !ok {
+		return
+	}
+	if ttl > c.ttl || ttl < 0 {
+		ttl = c.ttl
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= cacheMaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= cacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = &cacheEntry{
+		statusCode: statusCode,
+		header:     header.Clone(),
+		body:       body,
+		expires:    now.Add(ttl),
+	}
+}
+
+// cacheTTL returns the freshness lifetime of the response at now less its
+// Age, from s-maxage, max-age or Expires in the order, it's -1 if there is
+// none of them but the response is public. ok is false if the response
+// must not be cached, which is the default without the explicit freshness,
+// the response may be of the user.
+func cacheTTL(header http.Header, now time.Time) (ttl time.Duration, ok bool) {
+	if _, ok := header["Set-Cookie"]; ok {
+		return 0, false
+	}
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			// The cache is only keyed by URL and encoding.
+			if name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+
+	maxAge, sMaxAge := -1, -1
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store", directive == "no-cache", directive == "private":
+				return 0, false
+			case strings.HasPrefix(directive, "max-age="):
+				seconds, ok := deltaSeconds(directive[len("max-age="):])
+				if !ok {
+					return 0, false
+				}
+				maxAge = seconds
+			case strings.HasPrefix(directive, "s-maxage="):
+				seconds, ok := deltaSeconds(directive[len("s-maxage="):])
+				if !ok {
+					return 0, false
+				}
+				sMaxAge = seconds
+			}
+		}
+	}
+
+	// https://tools.ietf.org/html/rfc7234#section-4.2.1
+	switch {
+	case sMaxAge >= 0:
+		ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		ttl = time.Duration(maxAge) * time.Second
+	case header.Get("Expires") != "":
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			// An invalid Expires, e.g. "0", means already expired.
+			return 0, false
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	case hasCacheDirective(header, "public"):
+		return -1, true
+	default:
+		return 0, false
+	}
+	if age, ok := deltaSeconds(header.Get("Age")); ok {
+		ttl -= time.Duration(age) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// deltaSeconds parses the non-negative number of seconds of a cache
+// directive or Age, which may be quoted.
+func deltaSeconds(v string) (int, bool) {
+	seconds, err := strconv.Atoi(strings.Trim(v, `"`))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return seconds, true
+}
+
+// hasCredentials reports whether r has the credentials of the user, which
+// are Authorization or Cookie.
+func hasCredentials(r *http.Request) bool {
+	if _, ok := r.Header["Authorization"]; ok {
+		return true
+	}
+	_, ok := r.Header["Cookie"]
+	return ok
+}
+
+// sharedWithAuthorization reports whether the response to a request with
+// Authorization may be stored by a shared cache, which is if it has the
+// public, s-maxage or must-revalidate directive.
+func sharedWithAuthorization(header http.Header) bool {
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "public" || directive == "must-revalidate" || strings.HasPrefix(directive, "s-maxage=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasCacheDirective reports whether the Cache-Control of header has the
+// directive, which is lower case.
+func hasCacheDirective(header http.Header, directive string) bool {
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			if strings.ToLower(strings.TrimSpace(d)) == directive {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serve writes the cached response to w.
+func (e *cacheEntry) serve(w http.ResponseWriter) {
+	header := w.Header()
+	for k, v := range e.header {
+		header[k] = v
+	}
+	w.WriteHeader(e.statusCode)
+	w.Write(e.body)
+}
+
+// captureWriter writes to w and keeps a copy of the written bytes, until
+// more than cacheMaxEntrySize bytes are written.
+type captureWriter struct {
+	w        io.Writer
+	buf      []byte
+	overflow bool
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if !c.overflow {
+		if len(c.buf)+n > cacheMaxEntrySize {
+			c.overflow = true
+			c.buf = nil
+		} else {
+			c.buf = append(c.buf, b[:n]...)
+		}
+	}
+	return n, err
+}
+
+// negotiationCache caches the negotiated encodings, keyed by the raw
+// Accept-Encoding of the requests.
+type negotiationCache struct {
+	size int
+
+	mu        sync.Mutex
+	encodings map[negotiationKey]EncodingType
+}
+
+type negotiationKey struct {
+	// present is false if the request has no Accept-Encoding.
+	present bool
+	value   string
+}
+
+func newNegotiationCache(size int) *negotiationCache {
+	return &negotiationCache{
+		size:      size,
+		encodings: make(map[negotiationKey]EncodingType, size),
+	}
+}
+
+// negotiationKeyOf returns the key of r, the Accept-Encoding lines are
+// merged as they are for negotiation. ok is false if Accept-Encoding is
+// longer than maxAcceptEncodingLength, it isn't cached, otherwise a client
+// could fill the cache with the large keys.
+func negotiationKeyOf(r *http.Request) (key negotiationKey, ok bool) {
+	values, ok := r.Header["Accept-Encoding"]
+	if !ok || len(values) == 0 {
+		return negotiationKey{}, true
+	}
+	size := len(values) - 1
+	for _, v := range values {
+		size += len(v)
+	}
+	if size > maxAcceptEncodingLength {
+		return negotiationKey{}, false
+	}
+	if len(values) > 1 {
+		return negotiationKey{present: true, value: strings.Join(values, ",")}, true
+	}
+	return negotiationKey{present: true, value: values[0]}, true
+}
+
+func (c *negotiationCache) get(key negotiationKey) (EncodingType, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	enc, ok := c.encodings[key]
+	return enc, ok
+}
+
+func (c *negotiationCache) put(key negotiationKey, enc EncodingType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.encodings) >= c.size {
+		// Start over once full, the common values are cached again soon.
+		c.encodings = make(map[negotiationKey]EncodingType, c.size)
+	}
+	c.encodings[key] = enc
+}
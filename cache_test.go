@@ -0,0 +1,398 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cacheHandler returns a caching handler and the number of calls of its
+// inner handler, the inner handler sets cacheControl.
+func cacheHandler(t *testing.T, cacheControl string, ttl time.Duration) (http.Handler, *int) {
+	header := http.Header{}
+	if cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+	return cacheHandlerHeader(t, header, ttl)
+}
+
+// cacheHandlerHeader is cacheHandler whose inner handler sets header.
+func cacheHandlerHeader(t *testing.T, header http.Header, ttl time.Duration) (http.Handler, *int) {
+	calls := 0
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, inner, WithResponseCache(ttl))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid cache ttl.")
+	}
+	return h, &calls
+}
+
+func serveCached(t *testing.T, h http.Handler) {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/cached", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("The response should be compressed.")
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("The response should be a valid gzip stream, %v.", err)
+	}
+	body, err := ioutil.ReadAll(gr)
+	if err != nil || !bytes.Equal(body, []byte("Hello, world.")) {
+		t.Fatalf("The response body should be decompressed to the original, got %q, %v.", body, err)
+	}
+}
+
+func TestWithResponseCache(t *testing.T) {
+	cfg := newConfig()
+	if cfg.cache != nil {
+		t.Fatalf("The response cache should be disabled by default.")
+	}
+	if err := WithResponseCache(time.Minute)(cfg); err != nil || cfg.cache == nil {
+		t.Fatalf("The response cache should be enabled, error %v.", err)
+	}
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if err := WithResponseCache(ttl)(cfg); err == nil {
+			t.Fatalf("An error should be returned for the cache ttl %v.", ttl)
+		}
+	}
+}
+
+func TestCacheNoStore(t *testing.T) {
+	h, calls := cacheHandler(t, "no-store", time.Hour)
+	serveCached(t, h)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("A no-store response should not be cached, the inner handler is called %d times.", *calls)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	for cacheControl, cached := range map[string]bool{
+		"":           false,
+		"max-age=60": true,
+		"public":     true,
+	} {
+		h, calls := cacheHandler(t, cacheControl, time.Hour)
+		serveCached(t, h)
+		serveCached(t, h)
+		if cached != (*calls == 1) {
+			t.Fatalf("The response with Cache-Control %q should be cached: %v, but the inner handler is called %d times.", cacheControl, cached, *calls)
+		}
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	h, calls := cacheHandler(t, "public, max-age=60", time.Hour)
+	serveCached(t, h)
+	serveCached(t, h)
+	if *calls != 1 {
+		t.Fatalf("A max-age=60 response should be cached, the inner handler is called %d times.", *calls)
+	}
+
+	now = now.Add(61 * time.Second)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("A max-age=60 response should expire after 60s, the inner handler is called %d times.", *calls)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	h, calls := cacheHandler(t, "max-age=3600", time.Minute)
+	serveCached(t, h)
+	now = now.Add(30 * time.Second)
+	serveCached(t, h)
+	if *calls != 1 {
+		t.Fatalf("The response should be cached within the ttl, the inner handler is called %d times.", *calls)
+	}
+	now = now.Add(31 * time.Second)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("The ttl should cap the max-age, the inner handler is called %d times.", *calls)
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	h, calls := cacheHandlerHeader(t, http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Age":           {"55"},
+	}, time.Hour)
+	serveCached(t, h)
+	now = now.Add(4 * time.Second)
+	serveCached(t, h)
+	if *calls != 1 {
+		t.Fatalf("The response should be fresh for max-age less Age, the inner handler is called %d times.", *calls)
+	}
+	now = now.Add(2 * time.Second)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("A max-age=60 response with Age: 55 should expire after 5s, the inner handler is called %d times.", *calls)
+	}
+
+	h, calls = cacheHandlerHeader(t, http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Age":           {"60"},
+	}, time.Hour)
+	serveCached(t, h)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("A response as old as its max-age shouldn't be cached, the inner handler is called %d times.", *calls)
+	}
+}
+
+func TestCacheSMaxAge(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	h, calls := cacheHandler(t, "max-age=3600, s-maxage=10", time.Hour)
+	serveCached(t, h)
+	now = now.Add(11 * time.Second)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("s-maxage should take precedence over max-age, the inner handler is called %d times.", *calls)
+	}
+
+	h, calls = cacheHandler(t, "max-age=3600, s-maxage=0", time.Hour)
+	serveCached(t, h)
+	serveCached(t, h)
+	if *calls != 2 {
+		t.Fatalf("A s-maxage=0 response shouldn't be cached, the inner handler is called %d times.", *calls)
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		fresh  time.Duration
+	}{
+		{"no Date", http.Header{
+			"Expires": {now.Add(time.Minute).UTC().Format(http.TimeFormat)},
+		}, time.Minute},
+		{"Date", http.Header{
+			"Date":    {now.Add(-30 * time.Second).UTC().Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Minute).UTC().Format(http.TimeFormat)},
+		}, 90 * time.Second},
+		{"max-age", http.Header{
+			"Cache-Control": {"max-age=10"},
+			"Expires":       {now.Add(time.Minute).UTC().Format(http.TimeFormat)},
+		}, 10 * time.Second},
+	}
+	for _, test := range tests {
+		start := now
+		h, calls := cacheHandlerHeader(t, test.header, time.Hour)
+		serveCached(t, h)
+		now = start.Add(test.fresh - time.Second)
+		serveCached(t, h)
+		if *calls != 1 {
+			t.Fatalf("The response with %s should be fresh for %v, the inner handler is called %d times.", test.name, test.fresh, *calls)
+		}
+		now = start.Add(test.fresh + time.Second)
+		serveCached(t, h)
+		if *calls != 2 {
+			t.Fatalf("The response with %s should expire after %v, the inner handler is called %d times.", test.name, test.fresh, *calls)
+		}
+		now = start
+	}
+
+	for _, expires := range []string{"0", now.Add(-time.Minute).UTC().Format(http.TimeFormat)} {
+		h, calls := cacheHandlerHeader(t, http.Header{"Expires": {expires}}, time.Hour)
+		serveCached(t, h)
+		serveCached(t, h)
+		if *calls != 2 {
+			t.Fatalf("The response expired by Expires: %s shouldn't be cached, the inner handler is called %d times.", expires, *calls)
+		}
+	}
+}
+
+func TestCacheAuthorization(t *testing.T) {
+	for cacheControl, cached := range map[string]bool{
+		"":                            false,
+		"max-age=60":                  false,
+		"public, max-age=60":          true,
+		"s-maxage=60":                 true,
+		"must-revalidate, max-age=60": true,
+	} {
+		h, calls := cacheHandler(t, cacheControl, time.Hour)
+		for _, auth := range []string{"Bearer alice", "Bearer bob"} {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/cached", nil)
+			r.Header.Add("Accept-Encoding", string(GZip))
+			r.Header.Set("Authorization", auth)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		if expected := map[bool]int{true: 1, false: 2}[cached]; *calls != expected {
+			t.Fatalf("The authorized response with Cache-Control %q should be cached: %v, but the inner handler is called %d times.",
+				cacheControl, cached, *calls)
+		}
+	}
+}
+
+func TestCacheCookie(t *testing.T) {
+	for _, cacheControl := range []string{"", "max-age=60"} {
+		calls := 0
+		// The page is rendered for the user of the cookie.
+		userh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "text/plain")
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			cookie, _ := r.Cookie("user")
+			w.Write([]byte("Hello, " + cookie.Value + "."))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, userh, WithResponseCache(time.Hour))
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid cache ttl.")
+		}
+		for _, user := range []string{"alice", "bob"} {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/home", nil)
+			r.Header.Add("Accept-Encoding", string(GZip))
+			r.AddCookie(&http.Cookie{Name: "user", Value: user})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("The response should be a valid gzip stream, %v.", err)
+			}
+			body, _ := ioutil.ReadAll(gr)
+			if want := "Hello, " + user + "."; string(body) != want {
+				t.Fatalf("The page of %s should be %q with Cache-Control %q, but is %q.", user, want, cacheControl, body)
+			}
+		}
+		if calls != 2 {
+			t.Fatalf("The page of each cookie should be rendered with Cache-Control %q, the inner handler is called %d times.", cacheControl, calls)
+		}
+	}
+}
+
+func TestCacheHost(t *testing.T) {
+	h, calls := cacheHandler(t, "public, max-age=60", time.Hour)
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		r := httptest.NewRequest(http.MethodGet, "/cached", nil)
+		r.Host = host
+		r.Header.Add("Accept-Encoding", string(GZip))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if *calls != 2 {
+		t.Fatalf("The responses should be cached per host, but the inner handler is called %d times.", *calls)
+	}
+}
+
+func TestWithNegotiationCache(t *testing.T) {
+	cfg := newConfig()
+	if cfg.negotiations != nil {
+		t.Fatalf("The negotiation cache should be disabled by default.")
+	}
+	if err := WithNegotiationCache(16)(cfg); err != nil || cfg.negotiations == nil {
+		t.Fatalf("The negotiation cache should be enabled, error %v.", err)
+	}
+	for _, size := range []int{0, -1} {
+		if err := WithNegotiationCache(size)(cfg); err == nil {
+			t.Fatalf("An error should be returned for the negotiation cache size %d.", size)
+		}
+	}
+}
+
+func TestNegotiationCache(t *testing.T) {
+	logger := &fakeLogger{}
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithNegotiationCache(16), WithStats(), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	cases := []struct {
+		acceptEncoding string
+		hit            bool
+	}{
+		{"gzip, br;q=0.5", false},
+		{"gzip, br;q=0.5", true},
+		{"identity", false},
+		{"gzip, br;q=0.5", true},
+	}
+	for _, c := range cases {
+		before := Stats()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", c.acceptEncoding)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		after := Stats()
+
+		hits := after.NegotiationCacheHits - before.NegotiationCacheHits
+		misses := after.NegotiationCacheMisses - before.NegotiationCacheMisses
+		if c.hit && (hits != 1 || misses != 0) {
+			t.Fatalf("Accept-Encoding %q should be a cache hit, but counted %d hits and %d misses.", c.acceptEncoding, hits, misses)
+		}
+		if !c.hit && (hits != 0 || misses != 1) {
+			t.Fatalf("Accept-Encoding %q should be a cache miss, but counted %d hits and %d misses.", c.acceptEncoding, hits, misses)
+		}
+		// Each request is logged with whether it's a cache hit.
+		logged := logger.messages[len(logger.messages)-1]
+		if want := fmt.Sprintf("negotiation cache hit: %v.", c.hit); !strings.HasPrefix(logged, "DEBUG") || !strings.HasSuffix(logged, want) {
+			t.Fatalf("Accept-Encoding %q should be logged with %q, but logged %q.", c.acceptEncoding, want, logged)
+		}
+	}
+}
+
+func TestNegotiationCacheLongValue(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithNegotiationCache(16))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	others := strings.Repeat("x, ", maxAcceptEncodingLength/3)
+	for _, values := range [][]string{{"gzip, " + others}, {"gzip", others}} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header["Accept-Encoding"] = values
+		if enc, _, _ := h.(*Handler).DryRun(r); enc != GZip {
+			t.Fatalf("The long Accept-Encoding should still be negotiated, but %q is selected.", enc)
+		}
+	}
+	if n := len(h.(*Handler).cfg.negotiations.encodings); n != 0 {
+		t.Fatalf("The Accept-Encoding longer than %d bytes should not be cached, but %d are cached.", maxAcceptEncodingLength, n)
+	}
+}
+
+func TestNegotiationCacheFull(t *testing.T) {
+	c := newNegotiationCache(2)
+	for i, value := range []string{"gzip", "br", "identity"} {
+		c.put(negotiationKey{present: true, value: value}, EncodingType(value))
+		if len(c.encodings) > 2 {
+			t.Fatalf("The cache should not be larger than 2 after %d puts, but is %d.", i+1, len(c.encodings))
+		}
+	}
+	if enc, ok := c.get(negotiationKey{present: true, value: "identity"}); !ok || enc != Identity {
+		t.Fatalf("The last put encoding should be cached, but got %q, %v.", enc, ok)
+	}
+	if _, ok := c.get(negotiationKey{}); ok {
+		t.Fatalf("The request without Accept-Encoding should not be cached.")
+	}
+}
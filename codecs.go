@@ -0,0 +1,432 @@
+package handler
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultBrotliLevel is the brotli level of the responses. The higher
+// levels are too slow for compressing the responses on the fly.
+const DefaultBrotliLevel = 5
+
+// DefaultZstdLevel is the zstd level of the responses.
+const DefaultZstdLevel = int(zstd.SpeedDefault)
+
+// encoder is the writer of a content coding, e.g. *gzip.Writer.
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+// codec is a content coding implemented by the handler.
+type codec struct {
+	encoding EncodingType
+	// minLevel is the lowest level, and pools pools the encoders of each
+	// level from minLevel.
+	minLevel int
+	pools    []sync.Pool
+	// newEncoder returns a new encoder of level writing to w, level must
+	// be valid.
+	newEncoder func(w io.Writer, level int) (encoder, error)
+}
+
+var gzipCodec = &codec{
+	encoding: GZip,
+	minLevel: gzip.HuffmanOnly,
+	pools:    make([]sync.Pool, gzip.BestCompression-gzip.HuffmanOnly+1),
+	newEncoder: func(w io.Writer, level int) (encoder, error) {
+		return gzip.NewWriterLevel(w, level)
+	},
+}
+
+var brotliCodec = &codec{
+	encoding: BR,
+	minLevel: brotli.BestSpeed,
+	pools:    make([]sync.Pool, brotli.BestCompression-brotli.BestSpeed+1),
+	newEncoder: func(w io.Writer, level int) (encoder, error) {
+		return brotli.NewWriterLevel(w, level), nil
+	},
+}
+
+// deflateCodec encodes the deflate coding, which is the zlib format of RFC
+// 1950 by RFC 7230, instead of the raw DEFLATE of RFC 1951. Some old
+// clients expected the raw one, but the browsers accept the zlib one.
+var deflateCodec = &codec{
+	encoding: Deflate,
+	minLevel: zlib.HuffmanOnly,
+	pools:    make([]sync.Pool, zlib.BestCompression-zlib.HuffmanOnly+1),
+	newEncoder: func(w io.Writer, level int) (encoder, error) {
+		return zlib.NewWriterLevel(w, level)
+	},
+}
+
+// zstdCodec pools the zstd encoders as well, they are expensive to create.
+var zstdCodec = &codec{
+	encoding: ZStd,
+	minLevel: int(zstd.SpeedFastest),
+	pools:    make([]sync.Pool, zstd.SpeedBestCompression-zstd.SpeedFastest+1),
+	newEncoder: func(w io.Writer, level int) (encoder, error) {
+		// A response is encoded by one goroutine, the concurrent ones are
+		// the requests.
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevel(level)),
+			zstd.WithEncoderConcurrency(1))
+	},
+}
+
+// codecs is the content codings implemented by the handler, except
+// identity.
+var codecs = map[EncodingType]*codec{
+	GZip:     gzipCodec,
+	BR:       brotliCodec,
+	Deflate:  deflateCodec,
+	ZStd:     zstdCodec,
+	Compress: compressCodec,
+}
+
+// compressCodec encodes the legacy compress coding, which is rarely used,
+// in the format of the Unix compress program, .Z, which compress/lzw
+// doesn't write. It has no levels, the level is always 0.
+var compressCodec = &codec{
+	encoding: Compress,
+	pools:    make([]sync.Pool, 1),
+	newEncoder: func(w io.Writer, level int) (encoder, error) {
+		l := &lzwEncoder{dict: make(map[uint32]uint32)}
+		l.Reset(w)
+		return l, nil
+	},
+}
+
+const (
+	// lzwMaxBits is the max code width, 16 as compress uses by default.
+	lzwMaxBits = 16
+	// lzwInitBits is the code width at the start and after a clear.
+	lzwInitBits = 9
+	// lzwClear is the code clearing the table in block mode.
+	lzwClear = 256
+	// lzwFirst is the first code of the table in block mode.
+	lzwFirst = 257
+	// lzwMaxCode is the number of codes of lzwMaxBits.
+	lzwMaxCode = 1 << lzwMaxBits
+	// lzwBufferSize is the size of the output written at once.
+	lzwBufferSize = 4096
+)
+
+// lzwEncoder is the encoder of compressCodec. The output is the magic
+// bytes 1F 9D, the flags byte of the max code width and block mode, then
+// the LZW codes, LSB first, from 9 to 16 bits. The table is cleared once
+// it's full. Like compress, the codes are written in groups of 8, so the
+// group of the last code before the width changes is padded, which the
+// decoders expect.
+type lzwEncoder struct {
+	w   io.Writer
+	buf []byte
+	err error
+	// bits is the pending bits of nbits, less than a byte between the
+	// codes.
+	bits  uint32
+	nbits uint
+	// width is the current code width, and count is the number of codes
+	// written with it in the current group.
+	width uint
+	count int
+	// freeEnt is the next code of the table of the decoder, which is
+	// one behind the encoder, as compress names it. first is true until
+	// the first code is written, which adds no code to the table.
+	freeEnt int
+	first   bool
+	// dict maps the prefix code and the next byte to the code, next is
+	// the next code of the table, and prefix is the code of the pending
+	// bytes, it's -1 if there is none.
+	dict   map[uint32]uint32
+	next   int
+	prefix int
+}
+
+func (l *lzwEncoder) Write(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	for _, c := range p {
+		if l.prefix < 0 {
+			l.prefix = int(c)
+			continue
+		}
+		key := uint32(l.prefix)<<8 | uint32(c)
+		if code, ok := l.dict[key]; ok {
+			l.prefix = int(code)
+			continue
+		}
+		l.writeCode(l.prefix)
+		if l.next < lzwMaxCode {
+			l.dict[key] = uint32(l.next)
+			l.next++
+		}
+		if l.next == lzwMaxCode {
+			// The table is full, it's cleared to adapt to the rest of the
+			// body.
+			l.writeCode(lzwClear)
+			l.clearTable()
+		}
+		l.prefix = int(c)
+	}
+	if len(l.buf) >= lzwBufferSize {
+		l.writeBuffer()
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	return len(p), nil
+}
+
+// writeCode writes code to the buffer, widening the codes first if the
+// decoder would.
+func (l *lzwEncoder) writeCode(code int) {
+	if l.freeEnt > l.maxCode() {
+		l.padGroup()
+		l.width++
+	}
+	l.writeBits(uint32(code))
+	l.count++
+	switch {
+	case code == lzwClear:
+		l.padGroup()
+		l.width = lzwInitBits
+		l.freeEnt = lzwClear
+	case l.first:
+		l.first = false
+	case l.freeEnt < lzwMaxCode:
+		l.freeEnt++
+	}
+}
+
+// maxCode returns the max code of the current width.
+func (l *lzwEncoder) maxCode() int {
+	if l.width == lzwMaxBits {
+		return lzwMaxCode
+	}
+	return 1<<l.width - 1
+}
+
+// writeBits writes a code of the current width.
+func (l *lzwEncoder) writeBits(code uint32) {
+	l.bits |= code << l.nbits
+	l.nbits += l.width
+	for l.nbits >= 8 {
+		l.buf = append(l.buf, byte(l.bits))
+		l.bits >>= 8
+		l.nbits -= 8
+	}
+}
+
+// padGroup pads the current group of 8 codes with zeros, it ends at a
+// byte boundary then.
+func (l *lzwEncoder) padGroup() {
+	for l.count%8 != 0 {
+		l.writeBits(0)
+		l.count++
+	}
+	l.count = 0
+}
+
+func (l *lzwEncoder) clearTable() {
+	for k := range l.dict {
+		delete(l.dict, k)
+	}
+	l.next = lzwFirst
+}
+
+func (l *lzwEncoder) writeBuffer() {
+	if l.err == nil && len(l.buf) > 0 {
+		_, l.err = l.w.Write(l.buf)
+	}
+	l.buf = l.buf[:0]
+}
+
+// Flush writes the complete bytes, the pending code and bits can't be
+// written before Close.
+func (l *lzwEncoder) Flush() error {
+	l.writeBuffer()
+	return l.err
+}
+
+// Close writes the pending code, and the last bits padded to a byte.
+func (l *lzwEncoder) Close() error {
+	if l.prefix >= 0 {
+		l.writeCode(l.prefix)
+		l.prefix = -1
+	}
+	if l.nbits > 0 {
+		l.buf = append(l.buf, byte(l.bits))
+		l.bits, l.nbits = 0, 0
+	}
+	l.writeBuffer()
+	return l.err
+}
+
+func (l *lzwEncoder) Reset(w io.Writer) {
+	l.w = w
+	l.err = nil
+	l.buf = append(l.buf[:0], 0x1f, 0x9d, 0x80|lzwMaxBits)
+	l.bits, l.nbits = 0, 0
+	l.width = lzwInitBits
+	l.count = 0
+	l.freeEnt = lzwFirst
+	l.first = true
+	l.clearTable()
+	l.prefix = -1
+}
+
+// getEncoder returns a pooled encoder of level writing to w.
+func (c *codec) getEncoder(w io.Writer, level int) (encoder, error) {
+	pool := c.pool(level)
+	if pool == nil {
+		// newEncoder returns the error of an invalid level.
+		return c.newEncoder(w, level)
+	}
+	if encw, ok := pool.Get().(encoder); ok {
+		encw.Reset(w)
+		return encw, nil
+	}
+	return c.newEncoder(w, level)
+}
+
+func (c *codec) putEncoder(encw encoder, level int) {
+	if pool := c.pool(level); pool != nil {
+		pool.Put(encw)
+	}
+}
+
+// pool returns the pool of the encoders of level, it's nil if the encoders
+// aren't pooled or level is invalid.
+func (c *codec) pool(level int) *sync.Pool {
+	i := level - c.minLevel
+	if i < 0 || i >= len(c.pools) {
+		return nil
+	}
+	return &c.pools[i]
+}
+
+// factoryCodec returns the codec of enc whose encoders are created by
+// factory, they aren't pooled.
+func factoryCodec(enc EncodingType, factory func(io.Writer) (io.WriteCloser, error)) *codec {
+	return &codec{
+		encoding: enc,
+		newEncoder: func(w io.Writer, level int) (encoder, error) {
+			wc, err := factory(w)
+			if err != nil {
+				return nil, err
+			}
+			return factoryEncoder{wc}, nil
+		},
+	}
+}
+
+// factoryEncoder is the encoder of the writers created by a factory.
+type factoryEncoder struct {
+	io.WriteCloser
+}
+
+// Flush flushes the writer if it can be flushed.
+func (f factoryEncoder) Flush() error {
+	if flusher, ok := f.WriteCloser.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Reset isn't called, the factory encoders aren't pooled.
+func (f factoryEncoder) Reset(w io.Writer) {}
+
+var (
+	registryMu sync.RWMutex
+	// registeredCodecs is the codings registered by RegisterEncoding and
+	// OverrideEncoding, they take precedence over the built-in ones.
+	registeredCodecs map[EncodingType]*codec
+)
+
+// RegisterEncoding implements the custom content coding name by the writers
+// created by factory for all the handlers, e.g. an internal "x-mycorp"
+// coding, which is then accepted in Accept-Encoding and the allowed
+// encoding list, and negotiated like the built-in ones. name is case
+// insensitive, and must be a token. The standard codings, their aliases
+// and the registered ones can't be registered again, see OverrideEncoding.
+// It's meant to be called by init, the handlers created before don't
+// accept name in the allowed encoding list.
+func RegisterEncoding(name EncodingType, factory func(io.Writer) (io.WriteCloser, error)) error {
+	enc := EncodingType(strings.ToLower(string(name)))
+	if !isToken(string(enc)) {
+		return fmt.Errorf("invalid encoding name %q", name)
+	}
+	if verifyEncodingName(string(enc)) != "" {
+		return fmt.Errorf("encoding %s is already known, it can only be overridden", name)
+	}
+	return registerCodec(enc, factory)
+}
+
+// OverrideEncoding replaces the encoders of the standard or registered
+// coding enc with the writers created by factory for all the handlers,
+// e.g. to implement exi, or to use a faster gzip. WithEncoderFactory still
+// overrides it for a single handler.
+func OverrideEncoding(enc EncodingType, factory func(io.Writer) (io.WriteCloser, error)) error {
+	e := verifyEncodingName(strings.ToLower(string(enc)))
+	if e == "" || e == All || e == Identity {
+		return fmt.Errorf("encoding %s can't be overridden", enc)
+	}
+	return registerCodec(e, factory)
+}
+
+func registerCodec(enc EncodingType, factory func(io.Writer) (io.WriteCloser, error)) error {
+	if factory == nil {
+		return fmt.Errorf("no encoder factory for encoding %s", enc)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if registeredCodecs == nil {
+		registeredCodecs = make(map[EncodingType]*codec)
+	}
+	registeredCodecs[enc] = factoryCodec(enc, factory)
+	return nil
+}
+
+// registeredCodec returns the codec registered for enc.
+func registeredCodec(enc EncodingType) (*codec, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := registeredCodecs[enc]
+	return c, ok
+}
+
+// registeredEncodings returns the registered codings which aren't
+// standard, sorted.
+func registeredEncodings() []EncodingType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var encs []EncodingType
+	for enc := range registeredCodecs {
+		if !standardEncoding(enc) {
+			encs = append(encs, enc)
+		}
+	}
+	sort.Slice(encs, func(i, j int) bool { return encs[i] < encs[j] })
+	return encs
+}
+
+// implementedCodec returns the codec of enc shared by the handlers, the
+// registered one or the built-in one.
+func implementedCodec(enc EncodingType) (*codec, bool) {
+	if c, ok := registeredCodec(enc); ok {
+		return c, true
+	}
+	c, ok := codecs[enc]
+	return c, ok
+}
@@ -0,0 +1,348 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestWithEncoderFactory(t *testing.T) {
+	var created []*gzip.Writer
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		gzipw := gzip.NewWriter(w)
+		created = append(created, gzipw)
+		return gzipw, nil
+	}
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithEncoderFactory(GZip, factory))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoder factory.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if len(created) != 1 {
+		t.Fatalf("The custom factory should be used once, but is used %d times.", len(created))
+	}
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+	}
+	buf, err := ioutil.ReadAll(gr)
+	if err != nil || string(buf) != "Hello, world." {
+		t.Fatalf("The body should be [%s], but returned [%s], %v.", "Hello, world.", buf, err)
+	}
+
+	// The other handlers still use the built-in codec.
+	h, err = EncodingHandler([]EncodingType{GZip}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if len(created) != 1 {
+		t.Fatalf("The custom factory should not be used by the other handlers.")
+	}
+
+	for _, enc := range []EncodingType{"fdsafdsa", All, Identity} {
+		if err := WithEncoderFactory(enc, factory)(newConfig()); err == nil {
+			t.Fatalf("An error should be returned for the encoder factory of %s.", enc)
+		}
+	}
+	if err := WithEncoderFactory(GZip, nil)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for a nil encoder factory.")
+	}
+}
+
+func TestEncoderFactoryError(t *testing.T) {
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		return nil, errors.New("no encoder")
+	}
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithEncoderFactory(GZip, factory))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoder factory.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("The response should not be encoded, but Content-Encoding is %q.", w.Header().Get("Content-Encoding"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), []byte("Hello, world.")) {
+		t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", w.Body.Bytes())
+	}
+}
+
+func TestEncoderFactoryImplements(t *testing.T) {
+	// exi has no built-in codec, the factory implements it. The test
+	// encodes it with gzip, the body is opaque to the handler.
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}
+	h, err := EncodingHandler([]EncodingType{EXI}, origh, WithEncoderFactory(EXI, factory))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoder factory.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(EXI))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != string(EXI) {
+		t.Fatalf("The response should be encoded with %s, but status is %d and Content-Encoding is %q.",
+			EXI, w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+// passthroughWriter is the writer of a coding which doesn't change the
+// body.
+type passthroughWriter struct {
+	io.Writer
+}
+
+func (passthroughWriter) Close() error { return nil }
+
+// unregisterEncoding removes enc registered by a test.
+func unregisterEncoding(enc EncodingType) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registeredCodecs, enc)
+}
+
+func TestRegisterEncoding(t *testing.T) {
+	const myCorp EncodingType = "x-mycorp"
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		return passthroughWriter{w}, nil
+	}
+	if err := RegisterEncoding("X-MyCorp", factory); err != nil {
+		t.Fatalf("No error should be returned for a custom encoding, but returned %v.", err)
+	}
+	t.Cleanup(func() { unregisterEncoding(myCorp) })
+
+	supported := SupportedEncodings()
+	if !reflect.DeepEqual(supported, []EncodingType{BR, Compress, Deflate, GZip, Identity, ZStd, myCorp}) {
+		t.Fatalf("The registered encoding should be supported, but the supported encodings are %v.", supported)
+	}
+	all := AllEncodings()
+	if len(all) != len(knownEncodings)+1 || all[len(all)-1] != myCorp {
+		t.Fatalf("The registered encoding should be listed after the known ones, but all the encodings are %v.", all)
+	}
+	if !IsKnownEncoding(myCorp) {
+		t.Fatalf("The registered encoding should be known.")
+	}
+
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	})
+	h, err := EncodingHandler([]EncodingType{myCorp, GZip}, bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for the registered encoding, but returned %v.", err)
+	}
+	for encStr, ce := range map[string]string{
+		"x-mycorp":               string(myCorp),
+		"X-MYCORP;q=0.5, br":     string(myCorp),
+		"gzip, x-mycorp;q=0.5":   string(GZip),
+		"x-mycorp;q=0, identity": "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != ce {
+			t.Fatalf("%q should be selected for %q, but status is %d and Content-Encoding is %q.",
+				ce, encStr, w.Code, w.Header().Get("Content-Encoding"))
+		}
+		if ce == string(myCorp) && !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("The body should be written by the registered encoder.")
+		}
+	}
+
+	for _, enc := range []EncodingType{GZip, XGZip, EXI, Identity, All, myCorp, "X-MYCORP", "x mycorp", ""} {
+		if err := RegisterEncoding(enc, factory); err == nil {
+			t.Fatalf("An error should be returned for registering %q.", enc)
+		}
+	}
+	if err := RegisterEncoding("x-other", nil); err == nil {
+		t.Fatalf("An error should be returned for a nil factory.")
+	}
+}
+
+func TestOverrideEncoding(t *testing.T) {
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		return passthroughWriter{w}, nil
+	}
+	if _, err := EncodingHandler([]EncodingType{EXI}, origh); err == nil {
+		t.Fatalf("An error should be returned for the unsupported encoding.")
+	}
+	if err := OverrideEncoding(EXI, factory); err != nil {
+		t.Fatalf("No error should be returned for overriding exi, but returned %v.", err)
+	}
+	t.Cleanup(func() { unregisterEncoding(EXI) })
+	h, err := EncodingHandler([]EncodingType{EXI}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for the overridden encoding, but returned %v.", err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(EXI))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(EXI) || w.Body.String() != "Hello, world." {
+		t.Fatalf("The response should be encoded by the overriding encoder, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+
+	for _, enc := range []EncodingType{Identity, All, "x-unknown"} {
+		if err := OverrideEncoding(enc, factory); err == nil {
+			t.Fatalf("An error should be returned for overriding %q.", enc)
+		}
+	}
+}
+
+func benchmarkGzip(b *testing.B, opts ...Option) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, opts...)
+	if err != nil {
+		b.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func BenchmarkGzipPooled(b *testing.B) {
+	benchmarkGzip(b)
+}
+
+// BenchmarkGzipUnpooled creates a gzip writer per request, which allocates
+// the whole deflate state each time.
+func BenchmarkGzipUnpooled(b *testing.B) {
+	benchmarkGzip(b, WithoutPooling())
+}
+
+func TestCompress(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	})
+	h, err := EncodingHandler([]EncodingType{XCompress}, bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for i := 0; i < 2; i++ {
+		// The second response is encoded by the pooled encoder.
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", "x-compress")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != string(Compress) {
+			t.Fatalf("Content-Encoding should be %s, but is %q.", Compress, w.Header().Get("Content-Encoding"))
+		}
+		if decoded := uncompress(t, w.Body.Bytes()); !bytes.Equal(decoded, body) {
+			t.Fatalf("The body should be decoded to the original one.")
+		}
+	}
+}
+
+// uncompress decodes the .Z data by gzip, which implements the decoder of
+// the compress program. The test is skipped if there is no gzip.
+func uncompress(t *testing.T, data []byte) []byte {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("No gzip to decode the compress coding.")
+	}
+	decoded, err := gunzipZ(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip should decode the compress coding, but returned %v.", err)
+	}
+	return decoded
+}
+
+// gunzipZ decodes the .Z data by gzip -dc.
+func gunzipZ(data io.Reader) ([]byte, error) {
+	cmd := exec.Command("gzip", "-dc")
+	cmd.Stdin = data
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	decoded, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v, %s", err, stderr.Bytes())
+	}
+	return decoded, nil
+}
+
+func TestLZWEncoder(t *testing.T) {
+	// The pseudo random text fills the table a few times, so the codes are
+	// widened up to 16 bits and the table is cleared.
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"Hello", "world", "encode", "handler", "compress", " ", ", ", ".\n"}
+	var text bytes.Buffer
+	for text.Len() < 1<<20 {
+		text.WriteString(words[rnd.Intn(len(words))])
+		if rnd.Intn(10) == 0 {
+			text.WriteByte(byte(rnd.Intn(256)))
+		}
+	}
+	random := make([]byte, 300<<10)
+	rnd.Read(random)
+
+	encw, err := compressCodec.newEncoder(ioutil.Discard, 0)
+	if err != nil {
+		t.Fatalf("No error should be returned for creating the encoder, but returned %v.", err)
+	}
+	for name, body := range map[string][]byte{
+		"empty":    {},
+		"one byte": []byte("a"),
+		"repeated": bytes.Repeat([]byte("a"), 100000),
+		"text":     text.Bytes(),
+		"random":   random,
+	} {
+		var buf bytes.Buffer
+		encw.Reset(&buf)
+		// The body is written in the chunks of various sizes, and flushed
+		// in between.
+		for rest := body; len(rest) > 0; {
+			n := rnd.Intn(10000) + 1
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := encw.Write(rest[:n]); err != nil {
+				t.Fatalf("No error should be returned for writing %s, but returned %v.", name, err)
+			}
+			if n%3 == 0 {
+				encw.Flush()
+			}
+			rest = rest[n:]
+		}
+		if err := encw.Close(); err != nil {
+			t.Fatalf("No error should be returned for closing %s, but returned %v.", name, err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), []byte{0x1f, 0x9d, 0x90}) {
+			t.Fatalf("The %s output should start with the compress header, but is % x.", name, buf.Bytes()[:3])
+		}
+		if decoded := uncompress(t, buf.Bytes()); !bytes.Equal(decoded, body) {
+			t.Fatalf("The %s output should be decoded to the original %d bytes, but is %d bytes.", name, len(body), len(decoded))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DecodingHandler decodes the request bodies for next, by the
+// Content-Encoding of the requests. The stacked codings are decoded in the
+// reverse order they were applied, and the requests with the codings
+// which can't be decoded are answered with 415 Unsupported Media Type.
+// The body is decompressed lazily as next reads it, so it's only read from
+// the network as fast as next consumes it, and the reads fail once the
+// request context is done. The other requests are passed to next as they
+// are.
+func DecodingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encs, ok := requestCodings(r.Header)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType),
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		if len(encs) == 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		decoded := r.WithContext(r.Context())
+		decoded.Header = r.Header.Clone()
+		decoded.Header.Del("Content-Encoding")
+		decoded.Header.Del("Content-Length")
+		// The length of the decoded body is unknown.
+		decoded.ContentLength = -1
+		decoded.Body = &decodingBody{ctx: r.Context(), body: r.Body, encs: encs}
+		next.ServeHTTP(w, decoded)
+	})
+}
+
+// requestCodings returns the codings of Content-Encoding in the order they
+// were applied, without identity. false is returned if one of them can't
+// be decoded.
+func requestCodings(header http.Header) ([]EncodingType, bool) {
+	var encs []EncodingType
+	for _, value := range header.Values("Content-Encoding") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.TrimSpace(name) == "" {
+				continue
+			}
+			switch enc := verifyEncodingName(strings.ToLower(name)); enc {
+			case Identity:
+			case GZip, Deflate, BR, ZStd:
+				encs = append(encs, enc)
+			default:
+				return nil, false
+			}
+		}
+	}
+	return encs, true
+}
+
+// newDecoder returns the reader decoding r by enc, and the function
+// releasing it.
+func newDecoder(enc EncodingType, r io.Reader) (io.Reader, func(), error) {
+	switch enc {
+	case GZip:
+		gzipr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gzipr, func() { gzipr.Close() }, nil
+	case Deflate:
+		zlibr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zlibr, func() { zlibr.Close() }, nil
+	case BR:
+		return brotli.NewReader(r), func() {}, nil
+	case ZStd:
+		zstdr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zstdr, zstdr.Close, nil
+	}
+	panic("unexpected encoding " + string(enc))
+}
+
+// decodingBody decompresses body on read.
+type decodingBody struct {
+	ctx  context.Context
+	body io.ReadCloser
+	// encs are the codings of body in the order they were applied.
+	encs []EncodingType
+	// decoded is created by the first read, reading the headers of the
+	// codings.
+	decoded io.Reader
+	closers []func()
+	// err is the error creating the decoders.
+	err error
+}
+
+func (d *decodingBody) Read(p []byte) (int, error) {
+	if err := d.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.decoded == nil {
+		var r io.Reader = d.body
+		for i := len(d.encs) - 1; i >= 0; i-- {
+			decoder, closer, err := newDecoder(d.encs[i], r)
+			if err != nil {
+				d.release()
+				d.err = err
+				return 0, err
+			}
+			d.closers = append(d.closers, closer)
+			r = decoder
+		}
+		d.decoded = r
+	}
+	return d.decoded.Read(p)
+}
+
+// release releases the decoders created.
+func (d *decodingBody) release() {
+	for _, closer := range d.closers {
+		closer()
+	}
+	d.closers = nil
+}
+
+func (d *decodingBody) Close() error {
+	d.release()
+	return d.body.Close()
+}
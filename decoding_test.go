@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func gzipBytes(b []byte) []byte {
+	buf := &bytes.Buffer{}
+	gzipw, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	gzipw.Write(b)
+	gzipw.Close()
+	return buf.Bytes()
+}
+
+func TestDecodingHandler(t *testing.T) {
+	var body []byte
+	var ce string
+	var length int64
+	readh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		ce = r.Header.Get("Content-Encoding")
+		length = r.ContentLength
+	})
+	h := DecodingHandler(readh)
+
+	compressed := gzipBytes([]byte("Hello, world."))
+	r := httptest.NewRequest(http.MethodPost, "http://localhost", bytes.NewReader(compressed))
+	r.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if string(body) != "Hello, world." {
+		t.Fatalf("The body should be decoded to [%s], but is [%s].", "Hello, world.", body)
+	}
+	if ce != "" || length != -1 {
+		t.Fatalf("Content-Encoding and the length should be removed, but are %q and %d.", ce, length)
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("The original request should not be modified.")
+	}
+
+	// The plain body is passed through.
+	r = httptest.NewRequest(http.MethodPost, "http://localhost", bytes.NewReader([]byte("Hello, world.")))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if string(body) != "Hello, world." {
+		t.Fatalf("The plain body should be [%s], but is [%s].", "Hello, world.", body)
+	}
+}
+
+func TestDecodingBackpressure(t *testing.T) {
+	// The random data is incompressible, the compressed body is as large
+	// as the decompressed one.
+	plain := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(plain)
+	network := &countingReader{r: bytes.NewReader(gzipBytes(plain))}
+
+	slowh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if network.n != 0 {
+			t.Fatalf("The body should not be read before the inner handler reads it, %d bytes were read.", network.n)
+		}
+		chunk := make([]byte, 1024)
+		if _, err := io.ReadFull(r.Body, chunk); err != nil {
+			t.Fatalf("The body should be readable, but returned %v.", err)
+		}
+		if network.n > 64<<10 {
+			t.Fatalf("Only the data pulled by the inner handler should be read, but %d bytes were read.", network.n)
+		}
+	})
+	r := httptest.NewRequest(http.MethodPost, "http://localhost", network)
+	r.Header.Set("Content-Encoding", "gzip")
+	DecodingHandler(slowh).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestDecodingCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	readh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 4)
+		if _, err := r.Body.Read(chunk); err != nil {
+			t.Fatalf("The body should be readable, but returned %v.", err)
+		}
+		cancel()
+		if _, err := r.Body.Read(chunk); err != context.Canceled {
+			t.Fatalf("The read should fail with %v once canceled, but returned %v.", context.Canceled, err)
+		}
+	})
+	compressed := gzipBytes([]byte("Hello, world."))
+	r := httptest.NewRequest(http.MethodPost, "http://localhost", bytes.NewReader(compressed)).WithContext(ctx)
+	r.Header.Set("Content-Encoding", "gzip")
+	DecodingHandler(readh).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestDecodingStacked(t *testing.T) {
+	var body []byte
+	readh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	})
+	h := DecodingHandler(readh)
+
+	encode := func(enc EncodingType, b []byte) []byte {
+		buf := &bytes.Buffer{}
+		c, _ := newConfig().codec(enc)
+		encw, _ := c.newEncoder(buf, c.minLevel)
+		encw.Write(b)
+		encw.Close()
+		return buf.Bytes()
+	}
+	for _, encs := range [][]EncodingType{
+		{GZip}, {Deflate}, {BR}, {ZStd}, {BR, GZip}, {GZip, Identity, ZStd},
+	} {
+		compressed := []byte("Hello, world.")
+		names := make([]string, len(encs))
+		for i, enc := range encs {
+			if enc != Identity {
+				compressed = encode(enc, compressed)
+			}
+			names[i] = string(enc)
+		}
+		r := httptest.NewRequest(http.MethodPost, "http://localhost", bytes.NewReader(compressed))
+		r.Header.Set("Content-Encoding", strings.Join(names, ", "))
+		body = nil
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if string(body) != "Hello, world." {
+			t.Fatalf("The body encoded by %v should be decoded to [%s], but is [%s].", encs, "Hello, world.", body)
+		}
+	}
+}
+
+func TestDecodingUnsupported(t *testing.T) {
+	called := false
+	readh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	for _, ce := range []string{"compress", "gzip, fdsafdsa"} {
+		called = false
+		r := httptest.NewRequest(http.MethodPost, "http://localhost", bytes.NewReader([]byte("Hello, world.")))
+		r.Header.Set("Content-Encoding", ce)
+		w := httptest.NewRecorder()
+		DecodingHandler(readh).ServeHTTP(w, r)
+		if w.Code != http.StatusUnsupportedMediaType || called {
+			t.Fatalf("%s should be answered with %d, but got %d.", ce, http.StatusUnsupportedMediaType, w.Code)
+		}
+	}
+}
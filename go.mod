@@ -1,5 +1,8 @@
 module github.com/teramoby/encode-handler
 
-go 1.14
+go 1.25
 
-require github.com/sirupsen/logrus v1.6.0
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/klauspost/compress v1.20.1
+)
@@ -1,17 +1,19 @@
+// Package handler provides the http handlers which encode the responses by
+// the Accept-Encoding of the requests, and decode the encoded requests.
 package handler
 
 import (
-	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"math"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
+	"sync"
 )
 
 // EncodingType is type for Encodings
@@ -44,7 +46,8 @@ const (
 	All EncodingType = "*"
 )
 
-const preferEncoding = Identity
+// defaultPreferredEncodings is the default fallback chain "*" resolves to.
+var defaultPreferredEncodings = []EncodingType{Identity}
 
 type acceptEncodingItem struct {
 	encoding EncodingType
@@ -57,13 +60,81 @@ type disabledEncodingMap map[EncodingType]bool
 type acceptEncoding struct {
 	sortAcceptEncodings sortedAcceptEncodingList
 	disabledEncodings   disabledEncodingMap
+	// preference is the rank of the server preferred encodings, it's
+	// used to break the ties of encodings with the same qvalue.
+	preference map[EncodingType]int
+	// preferred is the fallback chain of encodings "*" resolves to.
+	preferred []EncodingType
+	// qFloors is the min qvalue of the encodings to be selected.
+	qFloors map[EncodingType]float64
+	// masked is the encodings the server doesn't support for now.
+	masked map[EncodingType]bool
+	// strict is true if the malformed Accept-Encoding is rejected, and
+	// malformed is true once a malformed element is parsed.
+	strict    bool
+	malformed bool
+	// maxEntries is the max number of the parsed list elements.
+	maxEntries int
 }
 
+// DefaultMaxAcceptEncodings is the default max number of the Accept-Encoding
+// list elements parsed, the rest are ignored.
+const DefaultMaxAcceptEncodings = 32
+
+// maxAcceptEncodingLength is the max length of Accept-Encoding parsed, the
+// elements beyond it are ignored.
+const maxAcceptEncodingLength = 4 << 10
+
+// malformedEncoding is negotiated for the malformed Accept-Encoding in
+// strict mode, it's never a valid encoding name.
+const malformedEncoding EncodingType = "malformed Accept-Encoding"
+
 // https://tools.ietf.org/html/rfc7231#section-5.3.1
-const qvalueExp = "^q=((1(\\.0{0,3})?)|(0(\\.\\d{0,3})?))$"
+// More than three digits are accepted, the extra precision is ignored.
+const qvalueExp = "^q=((1(\\.0*)?)|(0(\\.\\d*)?))$"
+
+var qvalueRegexp = regexp.MustCompile(qvalueExp)
 
 type sortedAcceptEncodings []acceptEncoding
 
+// knownEncodings is the IANA registered content codings, see
+// https://www.iana.org/assignments/http-parameters/http-parameters.xhtml#content-coding
+var knownEncodings = []EncodingType{
+	AES128GCM, BR, Compress, Deflate, EXI, GZip, Identity, Pack200GZip, ZStd,
+}
+
+// AllEncodings returns the known encodings, which are accepted in
+// Accept-Encoding and the allowed encoding list, followed by the ones
+// registered by RegisterEncoding. The aliases XCompress and XGZip are
+// accepted as well, but they aren't listed.
+func AllEncodings() []EncodingType {
+	encs := make([]EncodingType, len(knownEncodings))
+	copy(encs, knownEncodings)
+	return append(encs, registeredEncodings()...)
+}
+
+// SupportedEncodings returns the known encodings which the handlers can
+// encode the responses with, including identity, followed by the ones
+// registered by RegisterEncoding. The others are still accepted in the
+// allowed encoding list, but can only be encoded with WithEncoderFactory
+// or OverrideEncoding.
+func SupportedEncodings() []EncodingType {
+	var encs []EncodingType
+	for _, enc := range knownEncodings {
+		if _, ok := implementedCodec(enc); ok || enc == Identity {
+			encs = append(encs, enc)
+		}
+	}
+	return append(encs, registeredEncodings()...)
+}
+
+// IsKnownEncoding reports whether enc is a known encoding or an alias, or
+// is registered by RegisterEncoding.
+func IsKnownEncoding(enc EncodingType) bool {
+	enc = verifyEncodingName(string(enc))
+	return enc != "" && enc != All
+}
+
 func verifyEncodingName(name string) EncodingType {
 	enc := EncodingType(strings.TrimSpace(name))
 	switch enc {
@@ -76,20 +147,39 @@ func verifyEncodingName(name string) EncodingType {
 		return GZip
 	default:
 	}
+	if _, ok := registeredCodec(enc); ok {
+		// The custom coding registered by RegisterEncoding.
+		return enc
+	}
 	return ""
 }
 
+// standardEncoding reports whether enc is a known encoding or "*".
+func standardEncoding(enc EncodingType) bool {
+	switch enc {
+	case AES128GCM, BR, Compress, Deflate, EXI, GZip,
+		Identity, Pack200GZip, ZStd, All:
+		return true
+	}
+	return false
+}
+
 // For https://tools.ietf.org/html/rfc7231#section-5.3.1
 func getQValue(qv string) float64 {
 	qv = strings.TrimSpace(qv)
-	if matched, err := regexp.MatchString(qvalueExp, qv); !matched || err != nil {
-		if err != nil {
-			log.Errorf("Error %v while match expression with %s.", err, qvalueExp)
-		}
+	if !qvalueRegexp.MatchString(qv) {
 		return math.NaN()
 	}
 
 	num := qv[2:]
+	if len(num) > 5 {
+		// Truncate to three digits, e.g. 0.1234 is 0.123.
+		num = num[:5]
+		if ret, _ := strconv.ParseFloat(num, 64); ret == 0 && strings.Trim(qv[2:], "0.") != "" {
+			// e.g. 0.0001 isn't 0, which would be not acceptable.
+			return 0.001
+		}
+	}
 	// error can be ignored, because the input has already
 	// verified by the regular expression
 	ret, _ := strconv.ParseFloat(num, 64)
@@ -98,23 +188,139 @@ func getQValue(qv string) float64 {
 
 func newAcceptEncoding() acceptEncoding {
 	accEncoding := acceptEncoding{}
-	accEncoding.disabledEncodings = make(disabledEncodingMap)
-	accEncoding.sortAcceptEncodings = make(sortedAcceptEncodingList, 0)
+	// disabledEncodings is created by the first disabled encoding.
+	accEncoding.preferred = defaultPreferredEncodings
+	accEncoding.maxEntries = DefaultMaxAcceptEncodings
 
 	return accEncoding
 }
 
-func (a acceptEncoding) selectAcceptEncoding(encs map[EncodingType]bool, r *http.Request) EncodingType {
+// acceptEncodingPool pools the parsed Accept-Encoding, so the negotiation
+// doesn't allocate.
+var acceptEncodingPool = sync.Pool{
+	New: func() interface{} {
+		accEncoding := newAcceptEncoding()
+		return &accEncoding
+	},
+}
+
+// reset clears a for parsing another request, keeping the allocated list
+// and map.
+func (a *acceptEncoding) reset() {
+	a.clearParsed()
+	a.preference = nil
+	a.preferred = defaultPreferredEncodings
+	a.qFloors = nil
+	a.masked = nil
+	a.strict = false
+	a.maxEntries = DefaultMaxAcceptEncodings
+}
+
+// clearParsed clears the results of parseRequest, keeping the allocated
+// list and map.
+func (a *acceptEncoding) clearParsed() {
+	a.sortAcceptEncodings = a.sortAcceptEncodings[:0]
+	for enc := range a.disabledEncodings {
+		delete(a.disabledEncodings, enc)
+	}
+	a.malformed = false
+}
+
+// negotiate selects the encoding for the request from encs. It falls
+// back to identity if no encoding in encs is acceptable, and returns ""
+// if identity isn't acceptable either, which should be responded with
+// 406 Not Acceptable. malformedEncoding is returned for the malformed
+// Accept-Encoding in strict mode.
+func (a *acceptEncoding) negotiate(encs map[EncodingType]bool, r *http.Request) EncodingType {
+	enc := a.selectAcceptEncoding(encs, r)
+	if a.strict && a.malformed {
+		return malformedEncoding
+	}
+	if enc != "" {
+		return enc
+	}
+	if a.identityAcceptable() {
+		return Identity
+	}
+	return ""
+}
+
+// SelectEncoding negotiates the encoding for r from allowed, the same way as
+// the handler with the default options, without serving r, e.g. to pick
+// the precompressed variant of a file. It falls back to identity if no
+// encoding in allowed is acceptable, and returns false if identity isn't
+// acceptable either. The unknown encodings in allowed are ignored.
+func SelectEncoding(allowed []EncodingType, r *http.Request) (EncodingType, bool) {
+	encs := make(map[EncodingType]bool, len(allowed))
+	for _, enc := range allowed {
+		if enc = verifyEncodingName(string(enc)); enc != "" {
+			encs[enc] = true
+		}
+	}
+	preference, _ := preferenceRank(DefaultServerPreference)
+	accencs := acceptEncodingPool.Get().(*acceptEncoding)
+	accencs.reset()
+	accencs.preference = preference
+	enc := accencs.negotiate(encs, r)
+	acceptEncodingPool.Put(accencs)
+	return enc, enc != ""
+}
+
+// identityAcceptable reports whether identity is acceptable by the parsed
+// Accept-Encoding. Per https://tools.ietf.org/html/rfc7231#section-5.3.4,
+// it's acceptable unless excluded by "identity;q=0", or by "*;q=0" without
+// a more specific entry for identity.
+func (a *acceptEncoding) identityAcceptable() bool {
+	return !a.disabled(Identity)
+}
+
+// disabled reports whether enc is excluded by the parsed Accept-Encoding,
+// by "enc;q=0", or by "*;q=0" without a more specific entry for enc.
+func (a *acceptEncoding) disabled(enc EncodingType) bool {
+	if a.disabledEncodings[enc] {
+		return true
+	}
+	return !a.listed(enc) && a.disabledEncodings[All]
+}
+
+// listed reports whether enc is listed with a non-zero qvalue in the
+// parsed Accept-Encoding.
+func (a *acceptEncoding) listed(enc EncodingType) bool {
+	for _, accenc := range a.sortAcceptEncodings {
+		if accenc.encoding == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAcceptEncoding selects the encoding of the highest qvalue from
+// encs. "*" matches the codings not listed explicitly at its qvalue, the
+// listed codings are selected by their own qvalues, even if it's lower.
+func (a *acceptEncoding) selectAcceptEncoding(encs map[EncodingType]bool, r *http.Request) EncodingType {
 	a.parseRequest(r)
+	if len(a.preference) > 0 {
+		a.sortByPreference()
+	}
 	for _, accenc := range a.sortAcceptEncodings {
 		enc := accenc.encoding
 		if accenc.encoding == All {
-			// Return preferEncoding directly.
-			// TODO, callers can set this in the future.
-			enc = preferEncoding
+			// Select the first supported and enabled one in the chain,
+			// which isn't listed by the client.
+			for _, pref := range a.preferred {
+				if encs[pref] && !a.masked[pref] && !a.disabledEncodings[pref] && !a.listed(pref) &&
+					!a.belowFloor(pref, accenc.qvalue) {
+					return pref
+				}
+			}
+			continue
+		}
+		if a.belowFloor(enc, accenc.qvalue) {
+			// The client doesn't want it enough.
+			continue
 		}
 
-		if encs[enc] {
+		if encs[enc] && !a.masked[enc] {
 			// The encoding is suppoored by the handler
 			if !a.disabledEncodings[enc] {
 				return enc
@@ -128,7 +334,15 @@ func (a acceptEncoding) selectAcceptEncoding(encs map[EncodingType]bool, r *http
 	return ""
 }
 
+// belowFloor reports whether qvalue is below the qvalue floor of enc.
+func (a *acceptEncoding) belowFloor(enc EncodingType, qvalue float64) bool {
+	floor, ok := a.qFloors[enc]
+	return ok && qvalue < floor
+}
+
 func (a *acceptEncoding) parseRequest(r *http.Request) {
+	// The results of the previous parsing are replaced.
+	a.clearParsed()
 	values, ok := r.Header["Accept-Encoding"]
 	if !ok {
 		// No Accept-Encoding header found
@@ -137,11 +351,12 @@ func (a *acceptEncoding) parseRequest(r *http.Request) {
 		return
 	}
 
+	headerValue := values[0]
 	if len(values) > 1 {
-		log.Warnf("Multiple Accept-Encoding header found in request, the values are %v. Only the first one %s will be used.", values, values[0])
+		// https://tools.ietf.org/html/rfc7230#section-3.2.2
+		// Multiple header fields are equivalent to one comma-joined field.
+		headerValue = strings.Join(values, ",")
 	}
-
-	headerValue := values[0]
 	if len(headerValue) == 0 {
 		// Accept-Encoding is not found, returns identity directly.
 		a.sortAcceptEncodings = append(a.sortAcceptEncodings,
@@ -149,119 +364,557 @@ func (a *acceptEncoding) parseRequest(r *http.Request) {
 		return
 	}
 
+	if len(headerValue) > maxAcceptEncodingLength {
+		// Don't spend the time on a huge header, the element across the
+		// limit is dropped as well.
+		headerValue = headerValue[:maxAcceptEncodingLength]
+		if i := strings.LastIndexByte(headerValue, ','); i >= 0 {
+			headerValue = headerValue[:i]
+		} else {
+			headerValue = ""
+		}
+	}
+
 	// https://tools.ietf.org/html/rfc7231#section-3.1.2.1
 	// The value of encoding is case-insensitive
 	// So convert the value to lower case
 	headerValue = strings.ToLower(headerValue)
-	for _, oneEnc := range strings.Split(headerValue, ",") {
+	hasToken := false
+	entries := 0
+	for rest := headerValue; rest != ""; {
+		var oneEnc string
+		if i := strings.IndexByte(rest, ','); i >= 0 {
+			oneEnc, rest = rest[:i], rest[i+1:]
+		} else {
+			oneEnc, rest = rest, ""
+		}
+		// Some proxies emit leading, trailing or doubled commas,
+		// e.g. ", gzip, , br ,". Skip the empty list elements.
+		oneEnc = strings.TrimSpace(oneEnc)
+		if len(oneEnc) == 0 {
+			continue
+		}
+		if a.maxEntries > 0 && entries == a.maxEntries {
+			// The rest are ignored, the legit clients send a few.
+			break
+		}
+		entries++
+		hasToken = true
 		a.addOneAcceptEncoding(oneEnc)
 	}
-	// sort
-	sort.Slice(a.sortAcceptEncodings, func(i, j int) bool {
-		if math.Abs(a.sortAcceptEncodings[i].qvalue-a.sortAcceptEncodings[j].qvalue) < 0.0001 {
-			// The two qvalud are the same
-			if a.sortAcceptEncodings[i].encoding == "*" {
-				return false
-			}
-			if a.sortAcceptEncodings[j].encoding == "*" {
-				return true
-			}
-			// Dont swap the two encodings with same qvalue.
-			return false
+	if !hasToken {
+		// The header only has separators, which is an empty list,
+		// treat it the same as an empty Accept-Encoding.
+		a.sortAcceptEncodings = append(a.sortAcceptEncodings,
+			acceptEncodingItem{Identity, 1.0})
+		return
+	}
+	// Sort by qvalue. For the same qvalue, "*" sinks below the named
+	// codings, and the others keep the order of the client, the earlier
+	// listed the more preferred. sortItems is stable.
+	sortItems(a.sortAcceptEncodings, func(ei, ej acceptEncodingItem) bool {
+		if math.Abs(ei.qvalue-ej.qvalue) < 0.0001 {
+			return ei.encoding != All && ej.encoding == All
+		}
+		return ei.qvalue > ej.qvalue
+	})
+}
+
+// sortItems sorts items by less and keeps the order of the equal ones. It's
+// an insertion sort, which doesn't allocate like the sort package, the
+// lists are short.
+func sortItems(items []acceptEncodingItem, less func(ei, ej acceptEncodingItem) bool) {
+	for i := 1; i < len(items); i++ {
+		for j := i; j > 0 && less(items[j], items[j-1]); j-- {
+			items[j], items[j-1] = items[j-1], items[j]
 		}
-		return a.sortAcceptEncodings[i].qvalue > a.sortAcceptEncodings[j].qvalue
+	}
+}
+
+// sortByPreference reorders the encodings with the same qvalue by the
+// server preference. The encodings not in the preference keep the order
+// of the client after the preferred ones, and "*" is always the last.
+func (a *acceptEncoding) sortByPreference() {
+	rank := func(enc EncodingType) int {
+		if r, ok := a.preference[enc]; ok {
+			return r
+		}
+		if enc == All {
+			return len(a.preference) + 1
+		}
+		return len(a.preference)
+	}
+	sortItems(a.sortAcceptEncodings, func(ei, ej acceptEncodingItem) bool {
+		if math.Abs(ei.qvalue-ej.qvalue) >= 0.0001 {
+			return ei.qvalue > ej.qvalue
+		}
+		return rank(ei.encoding) < rank(ej.encoding)
 	})
 }
 
 func (a *acceptEncoding) addOneAcceptEncoding(oneEnc string) {
-	fs := strings.Split(oneEnc, ";")
-	if len(fs) < 1 || len(fs) > 2 {
-		// This is an invalid Accept-Encoding defination
-		return
+	name, params, hasParam := strings.Cut(oneEnc, ";")
+	qvalue, hasQ := "", false
+	if hasParam {
+		// The accept-ext parameters other than the qvalue are ignored, but
+		// the qvalue can't be duplicated.
+		for more := true; more; {
+			var param string
+			param, params, more = strings.Cut(params, ";")
+			param = strings.TrimSpace(param)
+			paramName, _, _ := strings.Cut(param, "=")
+			if !isToken(paramName) || (hasQ && strings.EqualFold(paramName, "q")) {
+				a.malformed = true
+				return
+			}
+			if strings.EqualFold(paramName, "q") {
+				qvalue, hasQ = param, true
+				if paramName == "Q" {
+					// The parameter names are case-insensitive.
+					qvalue = "q" + param[1:]
+				}
+			}
+		}
 	}
-	encName := verifyEncodingName(fs[0])
+	encName := verifyEncodingName(name)
 	if len(encName) == 0 {
 		// the encoding name doesn't have any content, this is an invalid Accept-Encoding defination
+		if !isToken(strings.TrimSpace(name)) {
+			// An unknown encoding isn't malformed, but a broken token is.
+			a.malformed = true
+		}
 		return
 	}
 	item := acceptEncodingItem{encName, 1.0}
-	if len(fs) == 2 {
-		item.qvalue = getQValue(fs[1])
+	if hasQ {
+		item.qvalue = getQValue(qvalue)
 		if math.IsNaN(item.qvalue) {
 			// This is an invalid qvalue.
+			a.malformed = true
 			return
 		}
 		if item.qvalue-0.0 < 0.0001 {
 			// Equals to zero, that means the encoding is disabled.
+			if a.disabledEncodings == nil {
+				a.disabledEncodings = make(disabledEncodingMap)
+			}
 			a.disabledEncodings[encName] = true
+			// The duplicate listed before is dropped, the disabled one
+			// wins whatever the order.
+			kept := a.sortAcceptEncodings[:0]
+			for _, listed := range a.sortAcceptEncodings {
+				if listed.encoding != encName {
+					kept = append(kept, listed)
+				}
+			}
+			a.sortAcceptEncodings = kept
 			return
 		}
 	}
+	if a.disabledEncodings[encName] {
+		// It's disabled by a duplicate.
+		return
+	}
 
 	a.sortAcceptEncodings = append(a.sortAcceptEncodings, item)
 }
 
-type gzipWriter struct {
-	httpw http.ResponseWriter
-	gzipw io.Writer
+// isToken reports whether s is a token of
+// https://tools.ietf.org/html/rfc7230#section-3.2.6
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
 }
 
-func (g *gzipWriter) Write(b []byte) (int, error) {
-	return g.gzipw.Write(b)
+var (
+	// ErrNoEncodings is returned if the allowed encoding list is empty.
+	ErrNoEncodings = errors.New("no item in allowedEncodingList")
+	// ErrNoValidEncodings is returned if the allowed encoding list has no
+	// known encoding.
+	ErrNoValidEncodings = errors.New("no valid encoding in allowedEncodingList")
+)
+
+// UnsupportedEncodingError is returned if none of the allowed encodings
+// can be encoded, they are known but not implemented, see
+// SupportedEncodings. It wraps ErrNoValidEncodings.
+type UnsupportedEncodingError struct {
+	Encodings []EncodingType
 }
 
-func (g *gzipWriter) WriteHeader(statusCode int) {
-	g.httpw.WriteHeader(statusCode)
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported encodings %v in allowedEncodingList", e.Encodings)
 }
 
-func (g *gzipWriter) Header() http.Header {
-	return g.httpw.Header()
+func (e *UnsupportedEncodingError) Unwrap() error {
+	return ErrNoValidEncodings
 }
 
-func gzipWrapper(next http.Handler, w http.ResponseWriter, r *http.Request) {
-	// gzip
-	gzipw := gzip.NewWriter(w)
-	defer gzipw.Close()
-	gw := gzipWriter{
-		httpw: w,
-		gzipw: gzipw,
-	}
-	gw.Header().Add("Content-Encoding", "gzip")
-	next.ServeHTTP(&gw, r)
+// EncodingSet is an immutable set of allowed encodings, it can be shared
+// by multiple handlers and is safe for concurrent use.
+type EncodingSet struct {
+	encs map[EncodingType]bool
+}
+
+// NewEncodingSet verifies the encodings in allowedEncodingList and builds
+// an EncodingSet of them.
+func NewEncodingSet(allowedEncodingList []EncodingType) (*EncodingSet, error) {
+	return newEncodingSet(allowedEncodingList, defaultLogger)
 }
 
-// EncodingHandler handles http requests with "Accept-Encoding" header
-func EncodingHandler(allowedEncodingList []EncodingType, next http.Handler) (http.Handler, error) {
+func newEncodingSet(allowedEncodingList []EncodingType, logger Logger) (*EncodingSet, error) {
 	if allowedEncodingList == nil || len(allowedEncodingList) == 0 {
-		log.Warnf("Inputed allowedEncodingList is null or empty.")
-		return next, fmt.Errorf("no item in allowedEncodingList")
+		logger.Warnf("Inputed allowedEncodingList is null or empty.")
+		return nil, ErrNoEncodings
 	}
 	allowedEncMap := make(map[EncodingType]bool, len(allowedEncodingList))
 	for _, encStr := range allowedEncodingList {
 		if enc := verifyEncodingName(string(encStr)); enc != "" {
 			allowedEncMap[enc] = true
 		} else {
-			log.Warnf("Unknow encoding %s.", encStr)
+			logger.Warnf("Unknow encoding %s.", encStr)
 		}
 	}
 	// No allowed encoding list was passed
 	if len(allowedEncMap) == 0 {
-		log.Warnf("No valid encoding in allowedEncodingList %v.", allowedEncodingList)
-		return next, fmt.Errorf("no valid encoding in allowedEncodingList")
+		logger.Warnf("No valid encoding in allowedEncodingList %v.", allowedEncodingList)
+		return nil, ErrNoValidEncodings
 	}
+	return &EncodingSet{encs: allowedEncMap}, nil
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		accencs := newAcceptEncoding()
-		selenc := accencs.selectAcceptEncoding(allowedEncMap, r)
+// list returns the encodings of s, sorted.
+func (s *EncodingSet) list() []EncodingType {
+	encs := make([]EncodingType, 0, len(s.encs))
+	for enc := range s.encs {
+		encs = append(encs, enc)
+	}
+	sort.Slice(encs, func(i, j int) bool { return encs[i] < encs[j] })
+	return encs
+}
 
-		switch selenc {
-		case GZip:
-			gzipWrapper(next, w, r)
-			return
-		case Identity:
-			next.ServeHTTP(w, r)
-			return
+// Contains reports whether enc is in the set.
+func (s *EncodingSet) Contains(enc EncodingType) bool {
+	return s.encs[verifyEncodingName(string(enc))]
+}
+
+// EncodingHandler handles http requests with "Accept-Encoding" header. It's
+// the same as NewEncodingHandler with WithAllowedEncodings.
+func EncodingHandler(allowedEncodingList []EncodingType, next http.Handler, opts ...Option) (http.Handler, error) {
+	return NewEncodingHandler(next, append([]Option{WithAllowedEncodings(allowedEncodingList...)}, opts...)...)
+}
+
+// EncodingSetHandler is the same as EncodingHandler, but the allowed
+// encodings are a prebuilt set, which can be shared by multiple handlers.
+// It's the same as NewEncodingHandler with WithEncodingSet.
+func EncodingSetHandler(set *EncodingSet, next http.Handler, opts ...Option) (http.Handler, error) {
+	if set == nil {
+		return next, fmt.Errorf("no EncodingSet")
+	}
+	return NewEncodingHandler(next, append([]Option{WithEncodingSet(set)}, opts...)...)
+}
+
+// defaultAllowedEncodings is the allowed encodings of NewEncodingHandler
+// without WithAllowedEncodings, which are the implemented ones.
+var defaultAllowedEncodings = []EncodingType{BR, ZStd, GZip, Deflate, Identity}
+
+// NewEncodingHandler returns a handler encoding the responses of next by
+// the Accept-Encoding of the requests, configured by opts. The allowed
+// encodings are set by WithAllowedEncodings or WithEncodingSet, the
+// default is all the implemented ones, br, zstd, gzip, deflate and
+// identity. The returned handler is a *Handler, or next with an error.
+func NewEncodingHandler(next http.Handler, opts ...Option) (http.Handler, error) {
+	cfg := newConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return next, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return next, err
+	}
+	set := cfg.set
+	if cfg.allowed != nil {
+		var err error
+		if set, err = newEncodingSet(cfg.allowed, cfg.logger); err != nil {
+			return next, err
+		}
+	}
+	if set == nil {
+		// The error can be ignored, the default encodings are valid.
+		set, _ = newEncodingSet(defaultAllowedEncodings, cfg.logger)
+	}
+	var unsupported []EncodingType
+	// The unsupported encodings are never negotiated, the client's next
+	// choice is selected instead.
+	encs := make(map[EncodingType]bool, len(set.encs))
+	for _, enc := range set.list() {
+		if enc == All {
+			continue
+		}
+		if _, ok := cfg.codec(enc); ok || enc == Identity {
+			encs[enc] = true
+		} else {
+			unsupported = append(unsupported, enc)
+		}
+	}
+	// "*" is never selected, it's neither supported nor unsupported.
+	if len(encs) == 0 && len(unsupported) > 0 {
+		cfg.logger.Warnf("No allowed encoding %v is supported.", unsupported)
+		return next, &UnsupportedEncodingError{Encodings: unsupported}
+	}
+	if len(unsupported) > 0 {
+		cfg.logger.Warnf("Allowed encodings %v aren't supported, they are never selected.", unsupported)
+	}
+	// The unsupported encodings are never selected, identity is the only
+	// one to serve if the rest are unsupported.
+	identityOnly := len(encs) == 1 && encs[Identity] && cfg.forcedEncoding == ""
+	h := &Handler{set: set, encs: encs, next: next, cfg: cfg, identityOnly: identityOnly}
+	if cfg.notAcceptableBody {
+		h.notAcceptable = notAcceptableBody(encs)
+	}
+	return h, nil
+}
+
+// Handler is the handler returned by EncodingHandler, it encodes the
+// responses of the inner handler by the Accept-Encoding of the requests.
+// If identity is the only allowed encoding which is supported,
+// Accept-Encoding is ignored and the requests are passed to the inner
+// handler directly.
+type Handler struct {
+	set *EncodingSet
+	// encs is the allowed encodings which are supported.
+	encs map[EncodingType]bool
+	next http.Handler
+	cfg  *config
+	// identityOnly is true if identity is the only allowed encoding, there
+	// is nothing to negotiate then, Accept-Encoding is ignored.
+	identityOnly bool
+	// notAcceptable is the body of the 406 responses.
+	notAcceptable []byte
+}
+
+// notAcceptableBody returns the JSON body of the 406 responses, listing
+// encs and identity, which is served if acceptable whether it's allowed or
+// not.
+func notAcceptableBody(encs map[EncodingType]bool) []byte {
+	supported := []EncodingType{Identity}
+	for enc := range encs {
+		if enc != Identity {
+			supported = append(supported, enc)
+		}
+	}
+	sort.Slice(supported, func(i, j int) bool { return supported[i] < supported[j] })
+	// The error can be ignored, the strings are always marshaled.
+	body, _ := json.Marshal(struct {
+		Supported []EncodingType `json:"supported"`
+	}{supported})
+	return body
+}
+
+// selectEncoding returns the encoding to serve r with, it's "" if no
+// encoding is acceptable. hit is true if it's from the negotiation cache.
+func (h *Handler) selectEncoding(r *http.Request) (enc EncodingType, hit bool) {
+	if h.cfg.requestFilter != nil && !h.cfg.requestFilter(r) {
+		return Identity, false
+	}
+	if h.cfg.bypassed(r) {
+		return Identity, false
+	}
+	if h.cfg.userAgentSkip != nil && h.cfg.userAgentSkip(r.UserAgent()) {
+		return Identity, false
+	}
+	if h.cfg.breachGuard != nil && h.cfg.breachGuard(r) {
+		return Identity, false
+	}
+	if _, ok := r.Header["Via"]; ok && h.cfg.proxiedSkip {
+		return Identity, false
+	}
+	if hasCacheDirective(r.Header, "no-transform") {
+		// The client doesn't want the representation to be transformed.
+		return Identity, false
+	}
+	if _, ok := r.Header["Range"]; ok {
+		// The ranges are of the identity body served by the inner
+		// handler, e.g. by http.ServeContent.
+		return Identity, false
+	}
+	if h.cfg.acceptEncodingRewrite != nil {
+		r = h.rewriteAcceptEncoding(r)
+	}
+	var masked map[EncodingType]bool
+	if h.cfg.disabledEncodings != nil {
+		masked = h.cfg.disabledEncodings()
+	}
+	if forced := h.cfg.forcedEncoding; forced != "" && !masked[forced] && !h.clientDisabled(r, forced) {
+		return forced, false
+	}
+	if h.cfg.negotiations == nil {
+		return h.negotiate(r, masked), false
+	}
+
+	key, ok := negotiationKeyOf(r)
+	if !ok {
+		return h.negotiate(r, masked), false
+	}
+	enc, hit = h.cfg.negotiations.get(key)
+	if hit && masked[enc] {
+		// The cached encoding is disabled for now, the negotiation
+		// isn't cached as it's temporary.
+		enc, hit = h.negotiate(r, masked), false
+	} else if !hit {
+		enc = h.negotiate(r, masked)
+		if len(masked) == 0 {
+			h.cfg.negotiations.put(key, enc)
+		}
+	}
+	// Accept-Encoding isn't logged, it's the client input.
+	h.cfg.logger.Debugf("Negotiated encoding %q for %s, negotiation cache hit: %v.", enc, r.URL, hit)
+	return enc, hit
+}
+
+// rewriteAcceptEncoding returns a copy of r for negotiation, whose
+// Accept-Encoding is rewritten. r isn't modified.
+func (h *Handler) rewriteAcceptEncoding(r *http.Request) *http.Request {
+	raw, ok := r.Header["Accept-Encoding"]
+	value := ""
+	if ok && len(raw) > 0 {
+		value = strings.Join(raw, ",")
+	}
+	rewritten := h.cfg.acceptEncodingRewrite(r, value)
+	if !ok && rewritten == "" {
+		// Still no Accept-Encoding.
+		return r
+	}
+	nr := new(http.Request)
+	*nr = *r
+	nr.Header = r.Header.Clone()
+	nr.Header.Set("Accept-Encoding", rewritten)
+	return nr
+}
+
+func (h *Handler) negotiate(r *http.Request, masked map[EncodingType]bool) EncodingType {
+	accencs := acceptEncodingPool.Get().(*acceptEncoding)
+	accencs.reset()
+	accencs.preference = h.cfg.preference
+	accencs.preferred = h.cfg.preferred
+	accencs.qFloors = h.cfg.qFloors
+	accencs.masked = masked
+	accencs.strict = h.cfg.strictParsing
+	accencs.maxEntries = h.cfg.maxAcceptEncodings
+	enc := accencs.negotiate(h.encs, r)
+	acceptEncodingPool.Put(accencs)
+	return enc
+}
+
+// clientDisabled reports whether enc is disabled by the Accept-Encoding of
+// r.
+func (h *Handler) clientDisabled(r *http.Request, enc EncodingType) bool {
+	accencs := acceptEncodingPool.Get().(*acceptEncoding)
+	accencs.reset()
+	accencs.maxEntries = h.cfg.maxAcceptEncodings
+	accencs.parseRequest(r)
+	disabled := accencs.disabled(enc)
+	acceptEncodingPool.Put(accencs)
+	return disabled
+}
+
+// contextKey is the type of the context keys of the package.
+type contextKey struct {
+	name string
+}
+
+// EncodingContextKey is the context key of the encoding negotiated for the
+// request, which is passed to the inner handler. The value is of type
+// EncodingType, see EncodingFromContext.
+var EncodingContextKey = &contextKey{"encoding"}
+
+// EncodingFromContext returns the encoding negotiated for the request of
+// ctx. The response is encoded with it if it's compressible, and the inner
+// handler doesn't encode it itself, e.g. serves a precompressed file. It's
+// false if identity is negotiated, which isn't marked to keep the identity
+// path without allocations.
+func EncodingFromContext(ctx context.Context) (EncodingType, bool) {
+	enc, ok := ctx.Value(EncodingContextKey).(EncodingType)
+	return enc, ok
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.identityOnly {
+		// The response doesn't depend on Accept-Encoding, no Vary either.
+		if h.cfg.stats {
+			countEncoding(Identity)
+		}
+		h.cfg.selected(r, Identity, false)
+		h.cfg.setVariant(w.Header())
+		serveIdentity(h.next, w, r)
+		return
+	}
+	if !h.cfg.noVary {
+		// The response depends on Accept-Encoding, even if it isn't encoded.
+		addVary(w.Header())
+	}
+	enc, hit := h.selectEncoding(r)
+	if h.cfg.stats && h.cfg.negotiations != nil {
+		countNegotiation(hit)
+	}
+	if c, ok := h.cfg.codec(enc); ok {
+		encodeWrapper(h.next, w, r.WithContext(context.WithValue(r.Context(), EncodingContextKey, enc)), h.cfg, c)
+		return
+	}
+	if enc == Identity {
+		if h.cfg.stats {
+			countEncoding(Identity)
 		}
+		h.cfg.selected(r, Identity, false)
+		h.cfg.setVariant(w.Header())
+		serveIdentity(h.next, w, r)
+		return
+	}
+	h.cfg.selected(r, "", false)
+	if enc == malformedEncoding {
+		http.Error(w, "malformed Accept-Encoding", http.StatusBadRequest)
+		return
+	}
+	// No acceptable encoding, including identity.
+	if h.notAcceptable == nil {
 		w.WriteHeader(http.StatusNotAcceptable)
-	}), nil
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(h.notAcceptable)))
+	w.WriteHeader(http.StatusNotAcceptable)
+	w.Write(h.notAcceptable)
+}
+
+// DryRun returns the encoding the handler would select for r and the status
+// it would respond with, without serving r. The encoding is "" for 406 Not
+// Acceptable, and 400 Bad Request with WithStrictParsing. The decisions
+// made by the response, e.g. not to compress an image, aren't known before
+// serving.
+func (h *Handler) DryRun(r *http.Request) (EncodingType, int, error) {
+	if r == nil {
+		return "", 0, fmt.Errorf("no request")
+	}
+	if h.identityOnly {
+		return Identity, http.StatusOK, nil
+	}
+	enc, _ := h.selectEncoding(r)
+	if _, ok := h.cfg.codec(enc); ok || enc == Identity {
+		return enc, http.StatusOK, nil
+	}
+	if enc == malformedEncoding {
+		return "", http.StatusBadRequest, nil
+	}
+	return "", http.StatusNotAcceptable, nil
 }
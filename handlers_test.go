@@ -1,12 +1,27 @@
 package handler
 
 import (
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestGetQValue(t *testing.T) {
@@ -16,9 +31,6 @@ func TestGetQValue(t *testing.T) {
 		"q=":       math.NaN(), // only has q=
 		"q=fdsa":   math.NaN(), // not a number
 		"q=1.123":  math.NaN(), // should only be 1.000
-		"q=1.0000": math.NaN(), // should be 1.000, 1.0, 1.00
-		"q=0.0000": math.NaN(), // should be 0.000
-		"q=0.1234": math.NaN(), // should be 0.123
 		"q=2":      math.NaN(), // should not greater than 1
 		"q=00.123": math.NaN(), // should be 0.123
 		"q=22.000": math.NaN(), // invalid, should not be greater than 1
@@ -29,6 +41,16 @@ func TestGetQValue(t *testing.T) {
 		"q=0.000":  0,
 		"q=0.123":  0.123,
 		"q=0.999":  0.999,
+		// The extra precision is truncated.
+		"q=1.0000":   1.0,
+		"q=0.0000":   0,
+		"q=0.1234":   0.123,
+		"q=0.9999":   0.999,
+		"q=0.123456": 0.123,
+		"q=1.0001":   math.NaN(), // should not greater than 1
+		"q=0.1234a":  math.NaN(), // not a number
+		// It isn't truncated to 0, which is not acceptable.
+		"q=0.0001": 0.001,
 	}
 
 	for key, value := range cases {
@@ -70,6 +92,54 @@ func TestVerifyEncodingName(t *testing.T) {
 	}
 }
 
+func TestAllEncodings(t *testing.T) {
+	encs := AllEncodings()
+	found := make(map[EncodingType]bool, len(encs))
+	for _, enc := range encs {
+		if verifyEncodingName(string(enc)) != enc {
+			t.Fatalf("Encoding %s should be accepted by verifyEncodingName.", enc)
+		}
+		found[enc] = true
+	}
+	for _, enc := range []EncodingType{AES128GCM, BR, Compress, Deflate, EXI, GZip, Identity, Pack200GZip, ZStd} {
+		if !found[enc] {
+			t.Fatalf("Encoding %s should be in %v.", enc, encs)
+		}
+	}
+	for _, enc := range []EncodingType{All, XGZip, XCompress, "fdsafdsa", ""} {
+		if found[enc] {
+			t.Fatalf("Encoding %q should not be in %v.", enc, encs)
+		}
+	}
+
+	// The returned list is a copy.
+	encs[0] = "fdsafdsa"
+	if AllEncodings()[0] == "fdsafdsa" {
+		t.Fatalf("The known encodings should not be modified by the caller.")
+	}
+}
+
+func TestIsKnownEncoding(t *testing.T) {
+	cases := map[EncodingType]bool{
+		GZip:       true,
+		BR:         true,
+		ZStd:       true,
+		Deflate:    true,
+		Identity:   true,
+		XGZip:      true,
+		XCompress:  true,
+		" gzip ":   true,
+		All:        false,
+		"fdsafdsa": false,
+		"":         false,
+	}
+	for enc, expected := range cases {
+		if IsKnownEncoding(enc) != expected {
+			t.Fatalf("IsKnownEncoding(%q) should return %v.", enc, expected)
+		}
+	}
+}
+
 func TestAddOneAcceptEncoding(t *testing.T) {
 	encs := newAcceptEncoding()
 	encs.addOneAcceptEncoding("")
@@ -77,7 +147,7 @@ func TestAddOneAcceptEncoding(t *testing.T) {
 		t.Fatal("No item should be added for empty encoding.")
 	}
 
-	encStr := "gzip;q=0;a=1"
+	encStr := "gzip;q=0.5;q=1"
 	encs.addOneAcceptEncoding(encStr)
 	if len(encs.sortAcceptEncodings) != 0 {
 		t.Fatalf("No item should be added for invalid encoding %q.", encStr)
@@ -124,6 +194,40 @@ func TestAddOneAcceptEncoding(t *testing.T) {
 	verifyOneEncoding(t, encs.sortAcceptEncodings[1], "gzip", 1.0)
 }
 
+func TestAddOneAcceptEncodingExtensions(t *testing.T) {
+	cases := []struct {
+		encStr string
+		qvalue float64
+	}{
+		{"gzip;q=0.9;level=1", 0.9},
+		{"gzip; level=1 ;Q=0.9", 0.9},
+		{"gzip;level=1", 1.0},
+		{"gzip;x-foo=bar;q=0.5;x-bar", 0.5},
+	}
+	for _, c := range cases {
+		encs := newAcceptEncoding()
+		encs.addOneAcceptEncoding(c.encStr)
+		if len(encs.sortAcceptEncodings) != 1 || encs.malformed {
+			t.Fatalf("Only one encoding should be found while Accept-Encoding is %q.", c.encStr)
+		}
+		verifyOneEncoding(t, encs.sortAcceptEncodings[0], GZip, c.qvalue)
+	}
+
+	encs := newAcceptEncoding()
+	encs.addOneAcceptEncoding("gzip;q=0;a=1")
+	if len(encs.sortAcceptEncodings) != 0 || !encs.disabledEncodings[GZip] {
+		t.Fatalf("gzip should be disabled with the extension parameters.")
+	}
+
+	for _, encStr := range []string{"gzip;", "gzip;q=1;", "gzip;(a)=1", "gzip;q=0.5;q=1"} {
+		encs := newAcceptEncoding()
+		encs.addOneAcceptEncoding(encStr)
+		if len(encs.sortAcceptEncodings) != 0 || !encs.malformed {
+			t.Fatalf("No item should be added for invalid encoding %q.", encStr)
+		}
+	}
+}
+
 func TestParseRequest(t *testing.T) {
 	encs := newAcceptEncoding()
 	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
@@ -148,11 +252,22 @@ func TestParseRequest(t *testing.T) {
 	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
 	r.Header["Accept-Encoding"] = []string{"", "gzip"}
 	encs.parseRequest(r)
-	// verify if identity is present
+	// The empty line is an empty list element of the merged header.
 	if len(encs.sortAcceptEncodings) != 1 {
 		t.Fatal("Only one encoding should be found here.")
 	}
-	verifyOneEncoding(t, encs.sortAcceptEncodings[0], Identity, 1.0)
+	verifyOneEncoding(t, encs.sortAcceptEncodings[0], GZip, 1.0)
+
+	// Multiple lines are merged into one list.
+	encs = newAcceptEncoding()
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header["Accept-Encoding"] = []string{"gzip;q=0.5", "br;q=1"}
+	encs.parseRequest(r)
+	if len(encs.sortAcceptEncodings) != 2 {
+		t.Fatalf("Two encodings should be found while Accept-Encoding is %v.", r.Header["Accept-Encoding"])
+	}
+	verifyOneEncoding(t, encs.sortAcceptEncodings[0], BR, 1)
+	verifyOneEncoding(t, encs.sortAcceptEncodings[1], GZip, 0.5)
 
 	encs = newAcceptEncoding()
 	encStr := "gzip;q=0.5"
@@ -227,6 +342,258 @@ func TestParseRequest(t *testing.T) {
 	}
 }
 
+func TestEmptyAcceptEncoding(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	})
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	// https://tools.ietf.org/html/rfc7231#section-5.3.4
+	cases := []struct {
+		values []string
+		ce     string
+	}{
+		// No preference.
+		{nil, ""},
+		// Only identity is acceptable.
+		{[]string{""}, ""},
+		{[]string{"", ""}, ""},
+		// The merged lines are "gzip".
+		{[]string{"", "gzip"}, string(GZip)},
+		{[]string{"gzip", ""}, string(GZip)},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		if c.values != nil {
+			r.Header["Accept-Encoding"] = c.values
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != c.ce {
+			t.Fatalf("Content-Encoding should be %q for Accept-Encoding %q, but status is %d and Content-Encoding is %q.",
+				c.ce, c.values, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestLongAcceptEncoding(t *testing.T) {
+	// The entries after the first 32 ones aren't parsed.
+	entries := make([]string, 10000)
+	for i := range entries {
+		entries[i] = "fdsafdsa;q=0.5"
+	}
+	entries[31] = "br"
+	entries[32] = "gzip"
+	encStr := strings.Join(entries, ", ")
+
+	h, err := EncodingHandler([]EncodingType{BR, GZip}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", encStr)
+	encs := newAcceptEncoding()
+	encs.parseRequest(r)
+	if len(encs.sortAcceptEncodings) != 1 || encs.sortAcceptEncodings[0].encoding != BR {
+		t.Fatalf("Only br should be parsed within the first 32 entries, but parsed %v.", encs.sortAcceptEncodings)
+	}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("The negotiation of the long header should be bounded, but took %v.", elapsed)
+	}
+
+	// The limit is configurable.
+	h, err = EncodingHandler([]EncodingType{GZip}, origh, WithMaxAcceptEncodings(40))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("gzip should be parsed within the first 40 entries, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+	if err := WithMaxAcceptEncodings(0)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for max accept encodings 0.")
+	}
+
+	// The elements beyond 4KB aren't parsed, even within the limit.
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", strings.Repeat(" ", 4<<10)+", gzip")
+	encs = newAcceptEncoding()
+	encs.parseRequest(r)
+	if len(encs.sortAcceptEncodings) != 1 || encs.sortAcceptEncodings[0].encoding != Identity {
+		t.Fatalf("Nothing should be parsed beyond 4KB, but parsed %v.", encs.sortAcceptEncodings)
+	}
+}
+
+func TestWildcardListedEncodings(t *testing.T) {
+	cases := []struct {
+		allowed   []EncodingType
+		preferred []EncodingType
+		encStr    string
+		expected  EncodingType
+	}{
+		{[]EncodingType{GZip}, nil, "gzip;q=0.1,*;q=0.9", GZip},
+		{[]EncodingType{GZip}, []EncodingType{GZip, Identity}, "gzip;q=0.1,*;q=0.9", GZip},
+		// * doesn't raise the qvalue of the listed gzip.
+		{[]EncodingType{GZip, Identity}, []EncodingType{GZip, Identity}, "gzip;q=0.1,*;q=0.9", Identity},
+		{[]EncodingType{GZip, BR}, []EncodingType{GZip, Identity}, "br;q=0.1,*;q=0.9", GZip},
+		{[]EncodingType{GZip, BR}, []EncodingType{BR, GZip}, "br;q=0.1,*;q=0.9", GZip},
+	}
+	for _, c := range cases {
+		encs := newAcceptEncoding()
+		if c.preferred != nil {
+			encs.preferred = c.preferred
+		}
+		allowed := make(map[EncodingType]bool)
+		for _, enc := range c.allowed {
+			allowed[enc] = true
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", c.encStr)
+		if enc := encs.selectAcceptEncoding(allowed, r); enc != c.expected {
+			t.Fatalf("%q should be selected from %v preferring %v for %q, but selected %q.",
+				c.expected, c.allowed, c.preferred, c.encStr, enc)
+		}
+	}
+}
+
+func TestDeterministicSelection(t *testing.T) {
+	allowed := []EncodingType{ZStd, Deflate, GZip, BR, Identity}
+	cases := []struct {
+		opts     []Option
+		encStr   string
+		expected EncodingType
+	}{
+		{nil, "gzip, deflate, br, zstd", BR},
+		{nil, "deflate;q=0.5, gzip;q=0.5, exi", GZip},
+		{[]Option{WithServerPreference()}, "deflate, gzip, zstd", Deflate},
+		{[]Option{WithPreferredEncodings(ZStd, GZip)}, "*", ZStd},
+		{[]Option{WithPreferredEncodings(ZStd, GZip)}, "zstd;q=0.5, *", GZip},
+		{nil, "identity;q=0, exi", ""},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			// The maps are rebuilt by each handler, the iteration order
+			// of maps varies.
+			h, err := EncodingHandler(allowed, origh, c.opts...)
+			if err != nil {
+				t.Fatalf("No error should be returned for a valid encoding.")
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", c.encStr)
+			if enc, _, _ := h.(*Handler).DryRun(r); enc != c.expected {
+				t.Fatalf("%q should always be selected for %q, but selected %q by run %d.", c.expected, c.encStr, enc, i+1)
+			}
+		}
+	}
+}
+
+func TestSelectAcceptEncodingTwice(t *testing.T) {
+	encs := newAcceptEncoding()
+	allowed := map[EncodingType]bool{GZip: true, BR: true}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip;q=0.5, br, deflate;q=0, a(b)")
+	for i := 0; i < 2; i++ {
+		if enc := encs.selectAcceptEncoding(allowed, r); enc != BR {
+			t.Fatalf("br should be selected by call %d, but selected %q.", i+1, enc)
+		}
+		if len(encs.sortAcceptEncodings) != 2 || len(encs.disabledEncodings) != 1 || !encs.malformed {
+			t.Fatalf("The encodings should be parsed once by call %d, but are %v and disabled %v.",
+				i+1, encs.sortAcceptEncodings, encs.disabledEncodings)
+		}
+	}
+
+	// The results of the previous request don't leak.
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "deflate, gzip")
+	if enc := encs.selectAcceptEncoding(allowed, r); enc != GZip {
+		t.Fatalf("gzip should be selected, but selected %q.", enc)
+	}
+	if len(encs.sortAcceptEncodings) != 2 || len(encs.disabledEncodings) != 0 || encs.malformed {
+		t.Fatalf("Only the encodings of the request should be parsed, but are %v and disabled %v.",
+			encs.sortAcceptEncodings, encs.disabledEncodings)
+	}
+}
+
+func TestParseRequestTies(t *testing.T) {
+	cases := map[string][]EncodingType{
+		"br,gzip,deflate":             {BR, GZip, Deflate},
+		"deflate,gzip,br":             {Deflate, GZip, BR},
+		"*,br,gzip,deflate":           {BR, GZip, Deflate, All},
+		"gzip;q=0.5,*;q=0.5,br;q=0.5": {GZip, BR, All},
+		"gzip;q=0.5,deflate,br":       {Deflate, BR, GZip},
+	}
+	for encStr, expected := range cases {
+		encs := newAcceptEncoding()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		encs.parseRequest(r)
+		if len(encs.sortAcceptEncodings) != len(expected) {
+			t.Fatalf("%d encodings should be found while Accept-Encoding is %q, but found %v.",
+				len(expected), encStr, encs.sortAcceptEncodings)
+		}
+		for j, enc := range expected {
+			if encs.sortAcceptEncodings[j].encoding != enc {
+				t.Fatalf("The encodings should be sorted to %v while Accept-Encoding is %q, but are %v.",
+					expected, encStr, encs.sortAcceptEncodings)
+			}
+		}
+	}
+}
+
+func TestParseRequestMalformedSeparators(t *testing.T) {
+	cases := map[string][]EncodingType{
+		", gzip, , br ,": {GZip, BR},
+		",gzip":          {GZip},
+		"gzip,":          {GZip},
+		"gzip,,br":       {GZip, BR},
+		" , gzip ,  ,":   {GZip},
+		"gzip;q=0.5, ,":  {GZip},
+	}
+	for encStr, expected := range cases {
+		encs := newAcceptEncoding()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		encs.parseRequest(r)
+		if len(encs.sortAcceptEncodings) != len(expected) {
+			t.Fatalf("%d encodings should be found while Accept-Encoding is %q, but found %v.",
+				len(expected), encStr, encs.sortAcceptEncodings)
+		}
+		for i, enc := range expected {
+			if encs.sortAcceptEncodings[i].encoding != enc {
+				t.Fatalf("Encoding %s should be at position %d while Accept-Encoding is %q, but found %v.",
+					enc, i, encStr, encs.sortAcceptEncodings)
+			}
+		}
+		for _, item := range encs.sortAcceptEncodings {
+			if item.encoding == All {
+				t.Fatalf("No phantom %s should be added while Accept-Encoding is %q.", All, encStr)
+			}
+		}
+	}
+
+	// Only separators is an empty list, that means identity only.
+	for _, encStr := range []string{",", " , ,", ",,,"} {
+		encs := newAcceptEncoding()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		encs.parseRequest(r)
+		if len(encs.sortAcceptEncodings) != 1 {
+			t.Fatalf("Only one encoding should be found while Accept-Encoding is %q.", encStr)
+		}
+		verifyOneEncoding(t, encs.sortAcceptEncodings[0], Identity, 1.0)
+	}
+}
+
 func TestSelectAcceptEncoding(t *testing.T) {
 	supEncs := map[EncodingType]bool{
 		GZip:     true,
@@ -247,8 +614,8 @@ func TestSelectAcceptEncoding(t *testing.T) {
 	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
 	r.Header.Add("Accept-Encoding", encStr)
 	selected = encs.selectAcceptEncoding(supEncs, r)
-	if selected != preferEncoding {
-		t.Fatalf("%s should be selected for encoding %s, but returned %s.", preferEncoding, encStr, selected)
+	if selected != Identity {
+		t.Fatalf("%s should be selected for encoding %s, but returned %s.", Identity, encStr, selected)
 	}
 
 	encs = newAcceptEncoding()
@@ -261,6 +628,43 @@ func TestSelectAcceptEncoding(t *testing.T) {
 	}
 }
 
+func TestSelectEncoding(t *testing.T) {
+	allowed := []EncodingType{GZip, Identity}
+	cases := []struct {
+		encStr   string
+		expected EncodingType
+		ok       bool
+	}{
+		{"gzip;q=0.5,*;q=1,compress;q=0.8, identity;q=0", GZip, true},
+		{"gzip;q=0.5,*;q=1,compress;q=0.8", Identity, true},
+		{"br", Identity, true},
+		{"gzip;q=0, identity;q=0", "", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", c.encStr)
+		selected, ok := SelectEncoding(allowed, r)
+		if selected != c.expected || ok != c.ok {
+			t.Fatalf("(%q, %v) should be selected for encoding %s, but returned (%q, %v).",
+				c.expected, c.ok, c.encStr, selected, ok)
+		}
+	}
+
+	// The server preference breaks the ties.
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip, br")
+	if selected, _ := SelectEncoding([]EncodingType{GZip, BR}, r); selected != BR {
+		t.Fatalf("%s should be selected for encoding gzip, br, but returned %s.", BR, selected)
+	}
+
+	// No encodings are supported, only identity is acceptable.
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip;q=0.5,*;q=1,compress;q=0.8")
+	if selected, ok := SelectEncoding(nil, r); selected != Identity || !ok {
+		t.Fatalf("%s should be selected without supported encodings, but returned %s.", Identity, selected)
+	}
+}
+
 var origh = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Hello, world."))
@@ -271,24 +675,24 @@ func TestEncodingHandler(t *testing.T) {
 	if err == nil {
 		t.Fatalf("An error should be returned with nil encoding list.")
 	}
-	if err.Error() != "no item in allowedEncodingList" {
-		t.Fatalf("The error message should be [no item in allowedEncodingList], but returned [%s].", err.Error())
+	if !errors.Is(err, ErrNoEncodings) {
+		t.Fatalf("The error should be [%v], but returned [%v].", ErrNoEncodings, err)
 	}
 
-	_, err = EncodingHandler(nil, origh)
+	_, err = EncodingHandler([]EncodingType{}, origh)
 	if err == nil {
 		t.Fatalf("An error should be returned with empty encoding list.")
 	}
-	if err.Error() != "no item in allowedEncodingList" {
-		t.Fatalf("The error message should be [no item in allowedEncodingList], but returned [%s].", err.Error())
+	if !errors.Is(err, ErrNoEncodings) {
+		t.Fatalf("The error should be [%v], but returned [%v].", ErrNoEncodings, err)
 	}
 
 	_, err = EncodingHandler([]EncodingType{"fdsafdsa"}, origh)
 	if err == nil {
 		t.Fatalf("An error should be returned while no valid encoding passed.")
 	}
-	if err.Error() != "no valid encoding in allowedEncodingList" {
-		t.Fatalf("The error message should be [no valid encoding in allowedEncodingList], but returned [%s].", err.Error())
+	if !errors.Is(err, ErrNoValidEncodings) {
+		t.Fatalf("The error should be [%v], but returned [%v].", ErrNoValidEncodings, err)
 	}
 
 	if _, err := EncodingHandler([]EncodingType{"fdsfdsa", GZip}, origh); err != nil {
@@ -301,14 +705,188 @@ func TestEncodingHandler(t *testing.T) {
 		t.Fatalf("No error should be returned for a valid encoding.")
 	}
 
+	// The unsupported encoding is skipped, identity is the fallback.
 	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
 	r.Header.Add("Accept-Encoding", "EXI")
 	w := httptest.NewRecorder()
 	h.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Identity should be served while the inputted encoding is not supported, but returned %d.",
+			w.Result().StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "EXI, identity;q=0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
 	if w.Result().StatusCode != http.StatusNotAcceptable {
 		t.Fatalf("Status %d should be returned while the inputted encoding is not supported, but returned %d.",
 			http.StatusNotAcceptable, w.Result().StatusCode)
 	}
+
+	// The client's next choice is selected.
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "exi, gzip;q=0.5")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("gzip should be selected while exi is not supported, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+	if enc, _, _ := h.(*Handler).DryRun(r); enc != GZip {
+		t.Fatalf("DryRun should return gzip while exi is not supported, but returned %q.", enc)
+	}
+}
+
+func TestUnsupportedEncodings(t *testing.T) {
+	supported := SupportedEncodings()
+	if !reflect.DeepEqual(supported, []EncodingType{BR, Compress, Deflate, GZip, Identity, ZStd}) {
+		t.Fatalf("The supported encodings should be the implemented ones, but are %v.", supported)
+	}
+
+	for _, c := range []struct {
+		allowed, unsupported []EncodingType
+	}{
+		{[]EncodingType{EXI}, []EncodingType{EXI}},
+		{[]EncodingType{EXI, Pack200GZip}, []EncodingType{EXI, Pack200GZip}},
+		// "*" is never selected, so it's no supported encoding.
+		{[]EncodingType{All, EXI}, []EncodingType{EXI}},
+	} {
+		_, err := EncodingHandler(c.allowed, origh)
+		var unsupportedErr *UnsupportedEncodingError
+		if !errors.As(err, &unsupportedErr) || !reflect.DeepEqual(unsupportedErr.Encodings, c.unsupported) {
+			t.Fatalf("%v should be returned as unsupported for %v, but returned %v.", c.unsupported, c.allowed, err)
+		}
+		if !errors.Is(err, ErrNoValidEncodings) {
+			t.Fatalf("The error should wrap %v.", ErrNoValidEncodings)
+		}
+	}
+
+	// They're logged distinctly if there are supported ones.
+	logger := &fakeLogger{}
+	if _, err := EncodingHandler([]EncodingType{GZip, EXI, Pack200GZip}, origh, WithLogger(logger)); err != nil {
+		t.Fatalf("No error should be returned with a supported encoding, but returned %v.", err)
+	}
+	if !logger.logged("WARN", "[exi pack200-gzip] aren't supported") {
+		t.Fatalf("The unsupported encodings should be logged, but logged %v.", logger.messages)
+	}
+
+	// The encoder factory implements the encoding.
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}
+	if _, err := EncodingHandler([]EncodingType{EXI}, origh, WithEncoderFactory(EXI, factory)); err != nil {
+		t.Fatalf("No error should be returned for the encoding implemented by the factory, but returned %v.", err)
+	}
+}
+
+func TestEncodingSet(t *testing.T) {
+	if _, err := NewEncodingSet(nil); err == nil {
+		t.Fatalf("An error should be returned with nil encoding list.")
+	}
+	if _, err := NewEncodingSet([]EncodingType{"fdsafdsa"}); err == nil {
+		t.Fatalf("An error should be returned while no valid encoding passed.")
+	}
+	if _, err := EncodingSetHandler(nil, origh); err == nil {
+		t.Fatalf("An error should be returned with nil EncodingSet.")
+	}
+
+	set, err := NewEncodingSet([]EncodingType{XGZip, Identity, "fdsafdsa"})
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding, but returned %v.", err)
+	}
+	for enc, expected := range map[EncodingType]bool{GZip: true, XGZip: true, Identity: true, BR: false, "fdsafdsa": false} {
+		if set.Contains(enc) != expected {
+			t.Fatalf("Contains(%s) should return %v.", enc, expected)
+		}
+	}
+
+	// One set is shared by two handlers.
+	h1, err := EncodingSetHandler(set, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid EncodingSet.")
+	}
+	h2, err := EncodingSetHandler(set, origh, WithGzipLevel(gzip.BestSpeed))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid EncodingSet.")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, h := range []http.Handler{h1, h2} {
+			for encStr, ce := range map[string]string{"gzip": "gzip", "br, identity": ""} {
+				wg.Add(1)
+				go func(h http.Handler, encStr, ce string) {
+					defer wg.Done()
+					r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+					r.Header.Add("Accept-Encoding", encStr)
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, r)
+					if w.Header().Get("Content-Encoding") != ce {
+						t.Errorf("Content-Encoding should be %q for Accept-Encoding %q, but %q was returned.",
+							ce, encStr, w.Header().Get("Content-Encoding"))
+					}
+				}(h, encStr, ce)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestNotAcceptable(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	// https://tools.ietf.org/html/rfc7231#section-5.3.4
+	cases := map[string]int{
+		"br":                       http.StatusOK,
+		"br;q=0.5, identity;q=0.1": http.StatusOK,
+		"br, identity;q=0":         http.StatusNotAcceptable,
+		"*;q=0":                    http.StatusNotAcceptable,
+		"br, *;q=0":                http.StatusNotAcceptable,
+		"br, *;q=0, identity":      http.StatusOK,
+		"gzip, *;q=0":              http.StatusOK,
+		"gzip, identity;q=0":       http.StatusOK,
+		"identity;q=0":             http.StatusNotAcceptable,
+	}
+	for encStr, status := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != status {
+			t.Fatalf("Status %d should be returned for Accept-Encoding %q, but returned %d.",
+				status, encStr, w.Result().StatusCode)
+		}
+		if status == http.StatusOK && w.Header().Get("Content-Encoding") == "" &&
+			w.Body.String() != "Hello, world." {
+			t.Fatalf("The identity body should be [%s], but returned [%s].", "Hello, world.", w.Body.String())
+		}
+	}
+
+	// "*;q=0" disables the codings not listed, deflate is rejected.
+	for _, c := range []struct {
+		allowed []EncodingType
+		ce      string
+		status  int
+	}{
+		{[]EncodingType{Deflate}, "", http.StatusNotAcceptable},
+		{[]EncodingType{Deflate, GZip}, string(GZip), http.StatusOK},
+	} {
+		h, err := EncodingHandler(c.allowed, origh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", "*;q=0,gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status || w.Header().Get("Content-Encoding") != c.ce {
+			t.Fatalf("Status %d and Content-Encoding %q should be returned for %v, but returned %d and %q.",
+				c.status, c.ce, c.allowed, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
 }
 
 func TestGZip(t *testing.T) {
@@ -342,6 +920,96 @@ func TestGZip(t *testing.T) {
 	}
 }
 
+func TestBrotli(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip, BR}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(BR))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status %d should be returned for br but returned %d.",
+			http.StatusOK, w.Result().StatusCode)
+	}
+	if w.Header().Get("Content-Encoding") != string(BR) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			BR, w.Header().Get("Content-Encoding"))
+	}
+
+	buf, err := ioutil.ReadAll(brotli.NewReader(w.Body))
+	if err != nil {
+		t.Fatalf("Unable to read body from reader due to error %v.", err)
+	}
+	if string(buf) != "Hello, world." {
+		t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", string(buf))
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip, Deflate}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(Deflate))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status %d should be returned for deflate but returned %d.",
+			http.StatusOK, w.Result().StatusCode)
+	}
+	if w.Header().Get("Content-Encoding") != string(Deflate) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			Deflate, w.Header().Get("Content-Encoding"))
+	}
+
+	zr, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new zlib reader due to error %v.", err)
+	}
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Unable to read body from reader due to error %v.", err)
+	}
+	if string(buf) != "Hello, world." {
+		t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", string(buf))
+	}
+}
+
+func TestZstd(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip, ZStd}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(ZStd))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status %d should be returned for zstd but returned %d.",
+			http.StatusOK, w.Result().StatusCode)
+	}
+	if w.Header().Get("Content-Encoding") != string(ZStd) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			ZStd, w.Header().Get("Content-Encoding"))
+	}
+
+	zr, err := zstd.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new zstd reader due to error %v.", err)
+	}
+	defer zr.Close()
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Unable to read body from reader due to error %v.", err)
+	}
+	if string(buf) != "Hello, world." {
+		t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", string(buf))
+	}
+}
+
 func TestIdentity(t *testing.T) {
 	h, err := EncodingHandler([]EncodingType{GZip, Identity}, origh)
 	if err != nil {
@@ -368,8 +1036,728 @@ func TestIdentity(t *testing.T) {
 	}
 }
 
+func TestGZipDeadline(t *testing.T) {
+	// The clock is advanced by the writes, the deadline of the context is
+	// far enough not to be reached for real. The 7th write is within
+	// deadlineMargin of it.
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	deadline := now.Add(time.Hour + deadlineMargin/2)
+
+	var writeErr error
+	writes := 0
+	slowh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 100; i++ {
+			if _, writeErr = w.Write([]byte("Hello, world.")); writeErr != nil {
+				return
+			}
+			writes++
+			now = now.Add(10 * time.Minute)
+		}
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, slowh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil).WithContext(ctx)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if writes != 7 {
+		t.Fatalf("The writes should stop at the deadline after an hour, but %d writes of 10 minutes succeeded.", writes)
+	}
+	if !errors.Is(writeErr, context.DeadlineExceeded) {
+		t.Fatalf("Write should return %v after the deadline, but returned %v.", context.DeadlineExceeded, writeErr)
+	}
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+
+	// What was written before the deadline is still a valid gzip body.
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+	}
+	buf, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Unable to read body from reader due to error %v.", err)
+	}
+	if !bytes.Equal(buf, bytes.Repeat([]byte("Hello, world."), writes)) {
+		t.Fatalf("The body written before the deadline should be flushed, but is %q.", buf)
+	}
+}
+
+func TestGZipDeadlineTooClose(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithCacheVariantHeader("X-Cache-Variant"))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadlineMargin/2)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil).WithContext(ctx)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Content-Encoding should be empty when the deadline is too close, but %s was returned.",
+			w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.String() != "Hello, world." {
+		t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", w.Body.String())
+	}
+	if variant := w.Header().Get("X-Cache-Variant"); variant != string(Identity) {
+		t.Fatalf("The variant should be identity when the deadline is too close, but is %q.", variant)
+	}
+}
+
+func TestUserAgentSkip(t *testing.T) {
+	isCrawler := func(ua string) bool {
+		return strings.Contains(strings.ToLower(ua), "bot")
+	}
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithUserAgentSkip(isCrawler))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	uas := map[string]string{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": "",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0":     "gzip",
+	}
+	for ua, ce := range uas {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != ce {
+			t.Fatalf("Content-Encoding should be %q for User-Agent %q, but %q was returned.",
+				ce, ua, w.Header().Get("Content-Encoding"))
+		}
+		if ce == "" && w.Body.String() != "Hello, world." {
+			t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", w.Body.String())
+		}
+	}
+}
+
+func TestBreachGuard(t *testing.T) {
+	hasSecret := func(r *http.Request) bool {
+		return r.URL.Path == "/account"
+	}
+	h, err := EncodingHandler([]EncodingType{GZip}, origh, WithBreachGuard(hasSecret))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	paths := map[string]string{
+		"/account": "",
+		"/public":  "gzip",
+	}
+	for path, ce := range paths {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != ce {
+			t.Fatalf("Content-Encoding should be %q for path %s, but %q was returned.",
+				ce, path, w.Header().Get("Content-Encoding"))
+		}
+		if ce == "" && w.Body.String() != "Hello, world." {
+			t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", w.Body.String())
+		}
+	}
+}
+
+func TestRequestNoTransform(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	cacheControls := map[string]string{
+		"no-transform":            "",
+		"max-age=0, No-Transform": "",
+		"no-cache":                "gzip",
+	}
+	for cacheControl, ce := range cacheControls {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		r.Header.Set("Cache-Control", cacheControl)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != ce {
+			t.Fatalf("Content-Encoding should be %q for Cache-Control %q, but %q was returned.",
+				ce, cacheControl, w.Header().Get("Content-Encoding"))
+		}
+		if ce == "" && w.Body.String() != "Hello, world." {
+			t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", w.Body.String())
+		}
+	}
+}
+
+func TestEncodingFromContext(t *testing.T) {
+	var enc EncodingType
+	var ok bool
+	ctxh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc, ok = EncodingFromContext(r.Context())
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, ctxh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for encStr, expected := range map[string]EncodingType{"gzip": GZip, "identity": ""} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if enc != expected || ok != (expected != "") {
+			t.Fatalf("The encoding in the context should be %q for %s, but is %q, %v.", expected, encStr, enc, ok)
+		}
+	}
+}
+
+func TestRangeRequest(t *testing.T) {
+	content := bytes.Repeat([]byte("Hello, world."), 100)
+	contenth := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, contenth)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	r.Header.Set("Range", "bytes=0-99")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("The range request should not be encoded, but Content-Encoding is %q.", ce)
+	}
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[:100]) {
+		t.Fatalf("The first 100 bytes should be served with %d, but %d bytes are served with %d.",
+			http.StatusPartialContent, w.Body.Len(), w.Code)
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	content := bytes.Repeat([]byte("Hello, world."), 100)
+	// The type of hello.txt is by the extension, and hello's is sniffed.
+	for _, name := range []string{"hello.txt", "hello"} {
+		contenth := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, contenth)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		srv := httptest.NewServer(h)
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Add("Accept-Encoding", string(GZip))
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("The request should succeed, but returned %v.", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("%s should be encoded, but status is %d and Content-Encoding is %q.",
+				name, resp.StatusCode, resp.Header.Get("Content-Encoding"))
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Fatalf("The Content-Type of %s should be kept, but is %q.", name, ct)
+		}
+		encoded, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// The length of ServeContent is dropped, net/http may set the one
+		// of the encoded body if it's short.
+		if resp.ContentLength != -1 && resp.ContentLength != int64(len(encoded)) {
+			t.Fatalf("Content-Length of the encoded %s should be %d, but is %d.", name, len(encoded), resp.ContentLength)
+		}
+		gzipr, err := gzip.NewReader(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("The body should be gzip, but returned %v.", err)
+		}
+		decoded, err := io.ReadAll(gzipr)
+		if err != nil || !bytes.Equal(decoded, content) {
+			t.Fatalf("The whole %s should be decoded, but returned %v.", name, err)
+		}
+
+		req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Add("Accept-Encoding", string(GZip))
+		req.Header.Set("Range", "bytes=100-199")
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("The request should succeed, but returned %v.", err)
+		}
+		part, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("The range of %s should be served identity with %d, but status is %d and Content-Encoding is %q.",
+				name, http.StatusPartialContent, resp.StatusCode, resp.Header.Get("Content-Encoding"))
+		}
+		if cr := resp.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes 100-199/%d", len(content)) {
+			t.Fatalf("Content-Range of %s should be of the identity body, but is %q.", name, cr)
+		}
+		if resp.Header.Get("Content-Length") != "100" || !bytes.Equal(part, content[100:200]) {
+			t.Fatalf("The range of %s should be served, but %d bytes are served.", name, len(part))
+		}
+		srv.Close()
+	}
+}
+
+func TestAcceptEncodingRewrite(t *testing.T) {
+	stripBrotli := func(r *http.Request, acceptEncoding string) string {
+		var kept []string
+		for _, enc := range strings.Split(acceptEncoding, ",") {
+			if strings.TrimSpace(enc) != string(BR) {
+				kept = append(kept, enc)
+			}
+		}
+		return strings.Join(kept, ",")
+	}
+	var seen string
+	seenh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("Accept-Encoding")
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{BR, GZip}, seenh, WithAcceptEncodingRewrite(stripBrotli))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "br, gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s after br is stripped, but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+	if seen != "br, gzip" || r.Header.Get("Accept-Encoding") != "br, gzip" {
+		t.Fatalf("The request should not be modified, but the inner handler saw Accept-Encoding %q.", seen)
+	}
+
+	// The request without Accept-Encoding stays without one.
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("The request without Accept-Encoding should be served identity, but status is %d and Content-Encoding is %q.",
+			w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestVary(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	cases := []struct {
+		encStr string
+		vary   []string
+		result string
+	}{
+		{"gzip", nil, "Accept-Encoding"},
+		{"identity", nil, "Accept-Encoding"},
+		{"gzip", []string{"Accept-Language"}, "Accept-Language, Accept-Encoding"},
+		{"identity", []string{"Accept-Language"}, "Accept-Language, Accept-Encoding"},
+		// No duplicated token.
+		{"gzip", []string{"accept-encoding"}, "accept-encoding"},
+		{"gzip", []string{"Accept-Language", "Accept-Encoding"}, "Accept-Language"},
+		{"gzip", []string{"*"}, "*"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", c.encStr)
+		w := httptest.NewRecorder()
+		for _, v := range c.vary {
+			w.Header().Add("Vary", v)
+		}
+		h.ServeHTTP(w, r)
+		if vary := w.Header().Get("Vary"); vary != c.result {
+			t.Fatalf("Vary should be %q for %v and encoding %s, but is %q.", c.result, c.vary, c.encStr, vary)
+		}
+	}
+
+	// The inner handler replaces the Vary of the compressed response.
+	varyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("Hello, world."))
+	})
+	h, err = EncodingHandler([]EncodingType{GZip}, varyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if vary := w.Header().Get("Vary"); vary != "Accept-Language, Accept-Encoding" {
+		t.Fatalf("Vary should be %q, but is %q.", "Accept-Language, Accept-Encoding", vary)
+	}
+
+	// The Vary added to a response is its own, changing it in place
+	// doesn't change the ones of the other responses.
+	first, second := http.Header{}, http.Header{}
+	addVary(first)
+	first["Vary"][0] = "Cookie"
+	addVary(second)
+	if vary := second.Get("Vary"); vary != "Accept-Encoding" {
+		t.Fatalf("Vary should be %q, but is %q.", "Accept-Encoding", vary)
+	}
+}
+
+// nopHandler is an inner handler which doesn't allocate.
+var nopHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// raceEnabled is true if the tests are built with the race detector.
+var raceEnabled = false
+
+func TestIdentityNoAlloc(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector allocates.")
+	}
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, nopHandler)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for _, encStr := range []string{"", "identity", "br", "br;q=0.5, identity;q=0.8, gzip;q=0"} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		if encStr != "" {
+			r.Header.Set("Accept-Encoding", encStr)
+		}
+		w := httptest.NewRecorder()
+		// Each response adds Vary, which is its only allocation, so it's
+		// deleted for each run.
+		serve := func() {
+			delete(w.Header(), "Vary")
+			h.ServeHTTP(w, r)
+		}
+		if allocs := testing.AllocsPerRun(100, serve); allocs > 1 {
+			t.Fatalf("Serving identity for encoding %q should only allocate the Vary, but allocated %v times.", encStr, allocs)
+		}
+	}
+}
+
+func BenchmarkIdentity(b *testing.B) {
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, nopHandler)
+	if err != nil {
+		b.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Set("Accept-Encoding", "br;q=1.0, identity;q=0.5")
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(w, r)
+	}
+}
+
+func TestIdentityOnly(t *testing.T) {
+	// The unsupported encodings are never selected, identity is the only
+	// one to serve either way.
+	for _, allowed := range [][]EncodingType{{Identity}, {Identity, EXI}, {EXI, Identity, Pack200GZip}, {All, Identity, EXI}} {
+		h, err := EncodingHandler(allowed, origh)
+		if err != nil {
+			t.Fatalf("No error should be returned for %v, but returned %v.", allowed, err)
+		}
+		for _, encStr := range []string{"", "gzip", "exi", "identity;q=0"} {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			if encStr != "" {
+				r.Header.Set("Accept-Encoding", encStr)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != "Hello, world." {
+				t.Fatalf("The response should be passed through for encoding %q, but status is %d and body is %q.",
+					encStr, w.Code, w.Body.String())
+			}
+			if vary := w.Header().Get("Vary"); vary != "" {
+				t.Fatalf("No Vary should be added for identity only, but is %q.", vary)
+			}
+			if enc, status, _ := h.(*Handler).DryRun(r); enc != Identity || status != http.StatusOK {
+				t.Fatalf("DryRun should return identity for encoding %q, but returned %q and %d.", encStr, enc, status)
+			}
+		}
+	}
+}
+
+// BenchmarkIdentityOnly is compared with BenchmarkIdentity, which
+// negotiates identity.
+func BenchmarkIdentityOnly(b *testing.B) {
+	h, err := EncodingHandler([]EncodingType{Identity}, nopHandler)
+	if err != nil {
+		b.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Set("Accept-Encoding", "br;q=1.0, identity;q=0.5")
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(w, r)
+	}
+}
+
 func verifyOneEncoding(t *testing.T, item acceptEncodingItem, enc EncodingType, qvalue float64) {
 	if item.encoding != enc || item.qvalue-qvalue > 0.0001 {
 		t.Fatalf("Wrong encoding %v.", item)
 	}
 }
+
+func TestNewEncodingHandler(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	})
+	h, err := NewEncodingHandler(bodyh,
+		WithAllowedEncodings(GZip, Identity),
+		WithGzipLevel(gzip.BestCompression),
+		WithMinSize(len(body)),
+		WithPreferredEncoding(GZip))
+	if err != nil {
+		t.Fatalf("No error should be returned for valid options, but returned %v.", err)
+	}
+
+	serve := func(encStr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// WithAllowedEncodings, br isn't allowed.
+	if w := serve("br"); w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("br should not be allowed, but Content-Encoding is %q.", w.Header().Get("Content-Encoding"))
+	}
+	// WithPreferredEncoding and WithGzipLevel.
+	w := serve("*")
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("* should resolve to gzip, but Content-Encoding is %q.", w.Header().Get("Content-Encoding"))
+	}
+	best := &bytes.Buffer{}
+	gzipw, _ := gzip.NewWriterLevel(best, gzip.BestCompression)
+	gzipw.Write(body)
+	gzipw.Close()
+	if !bytes.Equal(w.Body.Bytes(), best.Bytes()) {
+		t.Fatalf("The body should be compressed with gzip level %d.", gzip.BestCompression)
+	}
+
+	// WithMinSize.
+	h, err = NewEncodingHandler(bodyh, WithAllowedEncodings(GZip), WithMinSize(len(body)+1))
+	if err != nil {
+		t.Fatalf("No error should be returned for valid options, but returned %v.", err)
+	}
+	if w := serve("gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("The body smaller than the min size should not be compressed, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+
+	// All the implemented encodings are allowed by default.
+	h, err = NewEncodingHandler(bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned without options, but returned %v.", err)
+	}
+	for _, enc := range []EncodingType{BR, ZStd, GZip, Deflate} {
+		if w := serve(string(enc)); w.Header().Get("Content-Encoding") != string(enc) {
+			t.Fatalf("%s should be allowed by default, but Content-Encoding is %q.", enc, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	for _, opt := range []Option{WithAllowedEncodings(), WithAllowedEncodings("fdsafdsa"), WithEncodingSet(nil)} {
+		if _, err := NewEncodingHandler(bodyh, opt); err == nil {
+			t.Fatalf("An error should be returned for invalid allowed encodings.")
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	h, err := EncodingHandler([]EncodingType{GZip, BR}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	handler := h.(*Handler)
+	for _, encStr := range []string{"gzip", "identity", "br;q=0, gzip;q=0", "identity;q=0", "*;q=0", "br", "deflate, gzip;q=0.5"} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		enc, status, err := handler.DryRun(r)
+		if err != nil {
+			t.Fatalf("No error should be returned for encoding %s, but returned %v.", encStr, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if status != w.Code {
+			t.Fatalf("The dry run status for encoding %s should be %d, but is %d.", encStr, w.Code, status)
+		}
+		served := EncodingType(w.Header().Get("Content-Encoding"))
+		if w.Code == http.StatusOK && served == "" {
+			served = Identity
+		}
+		if enc != served {
+			t.Fatalf("The dry run encoding for encoding %s should be %q, but is %q.", encStr, served, enc)
+		}
+	}
+	if _, _, err := handler.DryRun(nil); err == nil {
+		t.Fatalf("An error should be returned for a nil request.")
+	}
+}
+
+func FuzzParseAcceptEncoding(f *testing.F) {
+	for _, seed := range []string{
+		"", "gzip", "gzip;q=0.5,*;q=1,compress;q=0.8, identity;q=0", ", gzip, , br ,",
+		"gzip;q=0.5;q=1", "gzip;q=abc", "*;q=0,gzip", "gzip;q=0.1234", "x-gzip, X-Compress;Q=0.5",
+		"gzip;q=0, gzip", "é, br",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, encStr string) {
+		encs := newAcceptEncoding()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header["Accept-Encoding"] = []string{encStr}
+		encs.parseRequest(r)
+		for i, item := range encs.sortAcceptEncodings {
+			if math.IsNaN(item.qvalue) || item.qvalue <= 0 || item.qvalue > 1 {
+				t.Fatalf("The qvalue of %s should be in (0, 1] for %q, but is %v.", item.encoding, encStr, item.qvalue)
+			}
+			if i > 0 && item.qvalue > encs.sortAcceptEncodings[i-1].qvalue {
+				t.Fatalf("The encodings should be sorted by qvalue for %q, but are %v.", encStr, encs.sortAcceptEncodings)
+			}
+			if encs.disabledEncodings[item.encoding] {
+				t.Fatalf("The disabled encoding %s should not be listed for %q.", item.encoding, encStr)
+			}
+		}
+		// The negotiation doesn't panic either.
+		encs = newAcceptEncoding()
+		encs.negotiate(map[EncodingType]bool{GZip: true, BR: true, Identity: true}, r)
+	})
+}
+
+func TestPack200GZip(t *testing.T) {
+	// It's parsed from the requests.
+	encs := newAcceptEncoding()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "Pack200-GZip;q=0.5")
+	encs.parseRequest(r)
+	if len(encs.sortAcceptEncodings) != 1 {
+		t.Fatalf("Only one encoding should be found, but found %v.", encs.sortAcceptEncodings)
+	}
+	verifyOneEncoding(t, encs.sortAcceptEncodings[0], Pack200GZip, 0.5)
+
+	// It's unimplemented, alone it's rejected.
+	_, err := EncodingHandler([]EncodingType{Pack200GZip}, origh)
+	var unsupportedErr *UnsupportedEncodingError
+	if !errors.As(err, &unsupportedErr) || !reflect.DeepEqual(unsupportedErr.Encodings, []EncodingType{Pack200GZip}) {
+		t.Fatalf("pack200-gzip should be reported as unsupported, but returned %v.", err)
+	}
+
+	// And it's never negotiated.
+	h, err := EncodingHandler([]EncodingType{GZip, Pack200GZip}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned with a supported encoding, but returned %v.", err)
+	}
+	for encStr, status := range map[string]int{
+		"pack200-gzip, identity;q=0": http.StatusNotAcceptable,
+		"pack200-gzip, *;q=0":        http.StatusNotAcceptable,
+		// identity is acceptable unless it's excluded.
+		"pack200-gzip": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != status || w.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("Status %d should be returned without encoding for %q, but returned %d and Content-Encoding %q.",
+				status, encStr, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("No gzip to decode the compress coding.")
+	}
+	body := bytes.Repeat([]byte("Hello, world."), 1000)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "public")
+		// Written in pieces, the buffer and the encoder are both used.
+		for i := 0; i < len(body); i += 1000 {
+			w.Write(body[i : i+1000])
+		}
+	})
+	var disabled atomic.Value
+	disabled.Store(map[EncodingType]bool{})
+	h, err := EncodingHandler([]EncodingType{BR, ZStd, GZip, Deflate, Compress, Identity}, bodyh,
+		WithNegotiationCache(4), WithResponseCache(time.Minute), WithStats(),
+		WithServerPreference(BR, ZStd, GZip, Deflate, Compress),
+		WithDisabledEncodings(func() map[EncodingType]bool { return disabled.Load().(map[EncodingType]bool) }))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	cases := map[string]EncodingType{
+		"br":                    BR,
+		"zstd":                  ZStd,
+		"gzip":                  GZip,
+		"deflate":               Deflate,
+		"compress":              Compress,
+		"identity":              Identity,
+		"gzip;q=0.5, zstd":      ZStd,
+		"br;q=0.1, deflate":     Deflate,
+		"x-gzip, identity;q=0":  GZip,
+		"fdsafdsa, *;q=0, gzip": GZip,
+	}
+	var encStrs []string
+	for encStr := range cases {
+		encStrs = append(encStrs, encStr)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for i := 0; i < 400; i++ {
+		encStr := encStrs[i%len(encStrs)]
+		path := fmt.Sprintf("/%d", i%8)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+			r.Header.Add("Accept-Encoding", encStr)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			enc := cases[encStr]
+			ce := w.Header().Get("Content-Encoding")
+			if (enc == Identity && ce != "") || (enc != Identity && ce != string(enc)) {
+				errs <- fmt.Errorf("%q should be selected for %q, but Content-Encoding is %q", enc, encStr, ce)
+				return
+			}
+			decoded, err := decode(enc, w.Body)
+			if err != nil || !bytes.Equal(decoded, body) {
+				errs <- fmt.Errorf("the %s body for %q should be decoded, but returned %v", enc, encStr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// decode decodes the body encoded by enc.
+func decode(enc EncodingType, body io.Reader) ([]byte, error) {
+	switch enc {
+	case Identity:
+		return io.ReadAll(body)
+	case Compress:
+		return gunzipZ(body)
+	}
+	decoder, release, err := newDecoder(enc, body)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return io.ReadAll(decoder)
+}
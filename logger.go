@@ -0,0 +1,27 @@
+package handler
+
+import "log"
+
+// Logger logs the messages of the handlers, e.g. *logrus.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger logs the warnings and errors by the standard log package, and
+// drops the debug messages. It's the default Logger.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) {}
+
+func (stdLogger) Warnf(format string, args ...interface{}) {
+	log.Printf("[WARN] "+format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("[ERROR] "+format, args...)
+}
+
+// defaultLogger is the Logger without WithLogger.
+var defaultLogger Logger = stdLogger{}
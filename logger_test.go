@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeLogger keeps the logged messages.
+type fakeLogger struct {
+	messages []string
+}
+
+func (f *fakeLogger) Debugf(format string, args ...interface{}) {
+	f.messages = append(f.messages, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func (f *fakeLogger) Warnf(format string, args ...interface{}) {
+	f.messages = append(f.messages, "WARN "+fmt.Sprintf(format, args...))
+}
+
+func (f *fakeLogger) Errorf(format string, args ...interface{}) {
+	f.messages = append(f.messages, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+func (f *fakeLogger) logged(prefix, substr string) bool {
+	for _, m := range f.messages {
+		if strings.HasPrefix(m, prefix) && strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithLogger(t *testing.T) {
+	logger := &fakeLogger{}
+	h, err := EncodingHandler([]EncodingType{GZip, "fdsafdsa"}, origh, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	if !logger.logged("WARN", "fdsafdsa") {
+		t.Fatalf("The invalid encoding should be logged by the logger, but logged %v.", logger.messages)
+	}
+
+	h, err = EncodingHandler([]EncodingType{GZip}, origh, WithLogger(logger),
+		WithGzipLevelFunc(func(r *http.Request) int { return 100 }))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !logger.logged("WARN", "Invalid gzip level 100") {
+		t.Fatalf("The invalid gzip level should be logged by the logger, but logged %v.", logger.messages)
+	}
+
+	if _, err := NewEncodingHandler(origh, WithLogger(nil)); err == nil {
+		t.Fatalf("An error should be returned for a nil logger.")
+	}
+}
+
+func TestMalformedRequestsNotLogged(t *testing.T) {
+	// The standard log package is the default logger, nothing should be
+	// written to it either.
+	var stdout bytes.Buffer
+	log.SetOutput(&stdout)
+	defer log.SetOutput(os.Stderr)
+
+	inputs := []string{"gzip;q=abc", "gzip;q=0.5;q=1", "g(zip)", "fdsafdsa", ", ,", "gzip;", "*;q=2",
+		strings.Repeat("gzip, ", 100)}
+	for _, input := range inputs {
+		verifyEncodingName(input)
+		getQValue(input)
+		encs := newAcceptEncoding()
+		encs.addOneAcceptEncoding(input)
+	}
+
+	logger := &fakeLogger{}
+	for _, strict := range []bool{false, true} {
+		for _, cached := range []bool{false, true} {
+			opts := []Option{WithLogger(logger), WithStrictParsing(strict)}
+			if cached {
+				opts = append(opts, WithNegotiationCache(16))
+			}
+			h, err := EncodingHandler([]EncodingType{GZip}, origh, opts...)
+			if err != nil {
+				t.Fatalf("No error should be returned for a valid encoding.")
+			}
+			for _, input := range inputs {
+				r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				r.Header.Add("Accept-Encoding", input)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		}
+	}
+	// The decisions are logged at debug level with the negotiation cache,
+	// but neither the client input nor a warning.
+	for _, m := range logger.messages {
+		if !strings.HasPrefix(m, "DEBUG") {
+			t.Fatalf("Nothing should be logged above debug for the client input, but logged %q.", m)
+		}
+		for _, input := range inputs {
+			if strings.Contains(m, input) {
+				t.Fatalf("The client input %q should not be logged, but logged %q.", input, m)
+			}
+		}
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("Nothing should be logged for the client input, but logged %q.", stdout.String())
+	}
+}
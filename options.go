@@ -0,0 +1,825 @@
+package handler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option configures the handler returned by EncodingHandler.
+type Option func(*config) error
+
+type config struct {
+	// compressibleTypes is the Content-Type allowlist, it's
+	// DefaultCompressibleTypes unless set, and nil if incompressibleTypes
+	// is set instead.
+	compressibleTypes []string
+	// incompressibleTypes is nil if no response is excluded by type.
+	incompressibleTypes []string
+	// stats enables the package level counters returned by Stats.
+	stats bool
+	// preference is the rank of the encodings passed to WithServerPreference.
+	preference map[EncodingType]int
+	// maxBufferSize is the max size of body buffered before the
+	// compression decision.
+	maxBufferSize int
+	// gzipLevel is the compression level of gzip.
+	gzipLevel int
+	// gzipLevelFunc selects the gzip level per request if it isn't nil.
+	gzipLevelFunc func(*http.Request) int
+	// userAgentSkip returns true for the User-Agent served with identity.
+	userAgentSkip func(string) bool
+	// preferred is the fallback chain of encodings "*" resolves to.
+	preferred []EncodingType
+	// minSizeFunc returns the min size of body to compress for a
+	// Content-Type if it isn't nil.
+	minSizeFunc func(string) int
+	// cache is the compressed response cache, it's nil if disabled.
+	cache *responseCache
+	// stacked is true if the body encoded by the inner handler is
+	// encoded again.
+	stacked bool
+	// noPooling is true if the encoders aren't pooled.
+	noPooling bool
+	// qFloors is the min qvalue of the encodings to be selected.
+	qFloors     map[EncodingType]float64
+	breachGuard func(*http.Request) bool
+	// requestFilter returns false for the requests passed through as
+	// identity.
+	requestFilter func(*http.Request) bool
+	// bypassQueryParam is the query parameter serving identity, it's empty
+	// if there is none.
+	bypassQueryParam string
+	// notAcceptableBody is true if the 406 responses list the supported
+	// encodings.
+	notAcceptableBody bool
+	// strictParsing is true if the malformed Accept-Encoding is responded
+	// with 400 Bad Request.
+	strictParsing bool
+	// maxAcceptEncodings is the max number of the Accept-Encoding list
+	// elements parsed.
+	maxAcceptEncodings int
+	// negotiations is the negotiation cache, it's nil if disabled.
+	negotiations *negotiationCache
+	// proxiedSkip is true if the proxied requests, which have a Via
+	// header, are served identity.
+	proxiedSkip bool
+	// codecs overrides the built-in codecs.
+	codecs map[EncodingType]*codec
+	// requireContentType is true if the responses without Content-Type
+	// aren't compressed.
+	requireContentType    bool
+	acceptEncodingRewrite func(*http.Request, string) string
+	// noVary is true if Vary: Accept-Encoding isn't added.
+	noVary bool
+	// set is the allowed encodings, it's nil for the default ones. allowed
+	// is the list to build set of, it's verified once the logger is known.
+	set     *EncodingSet
+	allowed []EncodingType
+	logger  Logger
+	// closeErrorFunc is called with the error finishing a response.
+	closeErrorFunc func(*http.Request, error)
+	// onEncodingSelected is called with the decision of each request.
+	onEncodingSelected func(*http.Request, EncodingType, bool)
+	// compressionStats is called with the sizes of each compressed
+	// response.
+	compressionStats func(*http.Request, CompressionStats)
+	// disabledEncodings returns the encodings disabled for now.
+	disabledEncodings func() map[EncodingType]bool
+	// forcedEncoding is applied without negotiation unless the client
+	// disables it.
+	forcedEncoding EncodingType
+	// cacheVariantHeader is the response header of the content coding
+	// served.
+	cacheVariantHeader string
+	// legacyNames is true if x-gzip and x-compress are sent to the clients
+	// accepting only them.
+	legacyNames bool
+}
+
+// DefaultMaxBufferSize is the default max size of the response body
+// buffered for each request before the compression decision is made.
+const DefaultMaxBufferSize = 64 << 10
+
+// DefaultServerPreference is the default server preferred order of
+// encodings, the modern codecs are preferred, e.g. gzip is selected
+// before deflate for "Accept-Encoding: deflate, gzip".
+var DefaultServerPreference = []EncodingType{BR, ZStd, GZip, Deflate, Identity}
+
+func newConfig() *config {
+	// The error can be ignored, the default encodings are valid.
+	preference, _ := preferenceRank(DefaultServerPreference)
+	return &config{
+		maxBufferSize:      DefaultMaxBufferSize,
+		gzipLevel:          gzip.DefaultCompression,
+		preferred:          defaultPreferredEncodings,
+		preference:         preference,
+		maxAcceptEncodings: DefaultMaxAcceptEncodings,
+		logger:             defaultLogger,
+	}
+}
+
+// WithCloseErrorFunc calls f with the error finishing the encoded
+// response of r, e.g. the final compressed block can't be written to a
+// broken connection. The error is logged as well, at debug level if the
+// connection is gone.
+func WithCloseErrorFunc(f func(r *http.Request, err error)) Option {
+	return func(c *config) error {
+		if f == nil {
+			return fmt.Errorf("no close error func")
+		}
+		c.closeErrorFunc = f
+		return nil
+	}
+}
+
+// WithOnEncodingSelected calls f once for each request with the encoding
+// chosen for it and whether the response is compressed, before the body is
+// written, e.g. to count the responses by encoding. chosen is "" for 406
+// Not Acceptable, and 400 Bad Request with WithStrictParsing. The response
+// with the chosen encoding may still not be compressed, e.g. an image,
+// which is compressed false.
+func WithOnEncodingSelected(f func(r *http.Request, chosen EncodingType, compressed bool)) Option {
+	return func(c *config) error {
+		if f == nil {
+			return fmt.Errorf("no encoding selected func")
+		}
+		c.onEncodingSelected = f
+		return nil
+	}
+}
+
+// WithDisabledEncodings calls disabled for each request, and the allowed
+// encodings which are true in the returned map are negotiated as if they
+// weren't allowed, e.g. to turn off br during a CPU incident without
+// rebuilding the handler. disabled must be safe for concurrent use, and is
+// called often, so it should be cheap, e.g. loading an atomic.Value. The
+// keys are the canonical encodings, e.g. gzip but not x-gzip, and identity
+// can't be disabled.
+func WithDisabledEncodings(disabled func() map[EncodingType]bool) Option {
+	return func(c *config) error {
+		if disabled == nil {
+			return fmt.Errorf("no disabled encodings func")
+		}
+		c.disabledEncodings = disabled
+		return nil
+	}
+}
+
+// WithForcedEncoding applies enc to the responses whatever Accept-Encoding
+// is, e.g. for the links between the services whose clients omit it, unless
+// the client disables enc explicitly by "enc;q=0" or "*;q=0", then it's
+// negotiated as usual. enc must be implemented by the handler, and it's
+// applied even if it isn't allowed. The compressibility checks of the
+// responses are still applied.
+func WithForcedEncoding(enc EncodingType) Option {
+	return func(c *config) error {
+		e := verifyEncodingName(string(enc))
+		if _, ok := c.codec(e); !ok {
+			return fmt.Errorf("unsupported forced encoding %s", enc)
+		}
+		c.forcedEncoding = e
+		return nil
+	}
+}
+
+// WithCompressionStats calls f with the sizes of each compressed response
+// once it's written, e.g. to measure the compression ratio. Unlike
+// WithStats, the sizes are of the single response of r.
+func WithCompressionStats(f func(r *http.Request, stats CompressionStats)) Option {
+	return func(c *config) error {
+		if f == nil {
+			return fmt.Errorf("no compression stats func")
+		}
+		c.compressionStats = f
+		return nil
+	}
+}
+
+// selected reports the encoding chosen for r to onEncodingSelected.
+func (c *config) selected(r *http.Request, chosen EncodingType, compressed bool) {
+	if c.onEncodingSelected != nil {
+		c.onEncodingSelected(r, chosen, compressed)
+	}
+}
+
+// WithCacheVariantHeader sets the response header name to the content
+// coding of the served body, e.g. "X-Encoding: gzip", or identity if it
+// isn't encoded, for the caches and CDNs to key the variants on. Unlike
+// Vary, it's the variant produced, but not the request headers it depends
+// on. It isn't set for the 400 and 406 responses of the handler.
+func WithCacheVariantHeader(name string) Option {
+	return func(c *config) error {
+		if !isToken(name) {
+			return fmt.Errorf("invalid cache variant header %q", name)
+		}
+		c.cacheVariantHeader = name
+		return nil
+	}
+}
+
+// setVariant sets the cache variant header of header to the content coding
+// of the body.
+func (c *config) setVariant(header http.Header) {
+	if c.cacheVariantHeader == "" {
+		return
+	}
+	variant := header.Get("Content-Encoding")
+	if variant == "" {
+		variant = string(Identity)
+	}
+	header.Set(c.cacheVariantHeader, variant)
+}
+
+// WithLegacyEncodingNames sends "Content-Encoding: x-gzip" and x-compress
+// to the clients which accept only the legacy names, e.g. "Accept-Encoding:
+// x-gzip", instead of gzip and compress. The negotiation isn't changed,
+// x-gzip is still negotiated as gzip.
+func WithLegacyEncodingNames() Option {
+	return func(c *config) error {
+		c.legacyNames = true
+		return nil
+	}
+}
+
+// legacyEncodingNames is the legacy names of the encodings in
+// Content-Encoding.
+var legacyEncodingNames = map[EncodingType]EncodingType{
+	GZip:     XGZip,
+	Compress: XCompress,
+}
+
+// contentCoding returns the name of the coding of c in the Content-Encoding
+// of the response to r, which is the legacy one if r only accepts it.
+func (c *config) contentCoding(codec *codec, r *http.Request) EncodingType {
+	legacy, ok := legacyEncodingNames[codec.encoding]
+	if !c.legacyNames || !ok {
+		return codec.encoding
+	}
+	acceptLegacy := false
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for value != "" {
+			var elem string
+			elem, value, _ = strings.Cut(value, ",")
+			name, _, _ := strings.Cut(elem, ";")
+			name = strings.TrimSpace(name)
+			if strings.EqualFold(name, string(codec.encoding)) {
+				return codec.encoding
+			}
+			acceptLegacy = acceptLegacy || strings.EqualFold(name, string(legacy))
+		}
+	}
+	if acceptLegacy {
+		return legacy
+	}
+	return codec.encoding
+}
+
+// WithLogger logs the messages of the handler by logger instead of the
+// standard log package, which is the default for the warnings and errors.
+func WithLogger(logger Logger) Option {
+	return func(c *config) error {
+		if logger == nil {
+			return fmt.Errorf("no logger")
+		}
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithAllowedEncodings sets the encodings allowed by the handler, the
+// handler isn't created for an invalid list, the same as NewEncodingSet.
+func WithAllowedEncodings(encs ...EncodingType) Option {
+	return func(c *config) error {
+		// Never nil, an empty list is an error.
+		c.allowed = append([]EncodingType{}, encs...)
+		c.set = nil
+		return nil
+	}
+}
+
+// WithEncodingSet sets the encodings allowed by the handler to a prebuilt
+// set, which can be shared by multiple handlers.
+func WithEncodingSet(set *EncodingSet) Option {
+	return func(c *config) error {
+		if set == nil {
+			return fmt.Errorf("no EncodingSet")
+		}
+		c.set = set
+		c.allowed = nil
+		return nil
+	}
+}
+
+// DefaultCompressibleTypes is the default list of compressible
+// Content-Type prefixes, the responses of the other types aren't
+// compressed unless WithCompressibleTypes or WithIncompressibleTypes is
+// used.
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// WithCompressibleTypes restricts compression to the responses whose
+// Content-Type matches one of types. A type matches by prefix, e.g.
+// "text/" matches "text/html", and a trailing "*" is a wildcard, e.g.
+// "text/*". "*/*" matches all the types. The parameters of Content-Type,
+// like "; charset=utf-8", are ignored. DefaultCompressibleTypes is used
+// if types is empty, which is the default, and "*/*" compresses all the
+// types.
+func WithCompressibleTypes(types []string) Option {
+	return func(c *config) error {
+		if len(types) == 0 {
+			types = DefaultCompressibleTypes
+		}
+		c.compressibleTypes = normalizeTypes(types)
+		return nil
+	}
+}
+
+// WithIncompressibleTypes skips compression for the responses whose
+// Content-Type matches one of types, e.g. "image/png". The types are
+// matched the same as WithCompressibleTypes, which can't be used together
+// with this option, and the other types are all compressed.
+func WithIncompressibleTypes(types []string) Option {
+	return func(c *config) error {
+		c.incompressibleTypes = normalizeTypes(types)
+		return nil
+	}
+}
+
+func normalizeTypes(types []string) []string {
+	ret := make([]string, 0, len(types))
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) == 0 {
+			continue
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// validate verifies the config after all the options are applied.
+func (c *config) validate() error {
+	if c.compressibleTypes != nil && c.incompressibleTypes != nil {
+		return fmt.Errorf("WithCompressibleTypes and WithIncompressibleTypes can't be used together")
+	}
+	if c.compressibleTypes == nil && c.incompressibleTypes == nil {
+		// The binary responses, e.g. images, don't shrink, they're only
+		// compressed if asked to.
+		c.compressibleTypes = normalizeTypes(DefaultCompressibleTypes)
+	}
+	return nil
+}
+
+// matchContentType reports whether contentType matches one of types.
+func matchContentType(contentType string, types []string) bool {
+	// Strip the parameters, like "; charset=utf-8"
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, t := range types {
+		if t == "*/*" {
+			return true
+		}
+		if strings.HasPrefix(contentType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithStats enables updating the package level counters returned by Stats
+// for the responses served by the handler.
+func WithStats() Option {
+	return func(c *config) error {
+		c.stats = true
+		return nil
+	}
+}
+
+// WithServerPreference sets the server preferred order of encodings. The
+// encodings with the same qvalue in Accept-Encoding, including the ones
+// without qvalue which are 1, are selected in this order instead of the
+// order listed by the client. The encodings with different qvalues are
+// still selected by qvalue. The default is DefaultServerPreference, and
+// no encoding keeps the order of the client.
+func WithServerPreference(encs ...EncodingType) Option {
+	return func(c *config) error {
+		preference, err := preferenceRank(encs)
+		if err != nil {
+			return err
+		}
+		c.preference = preference
+		return nil
+	}
+}
+
+// preferenceRank returns the rank of each encoding in encs.
+func preferenceRank(encs []EncodingType) (map[EncodingType]int, error) {
+	preference := make(map[EncodingType]int, len(encs))
+	for _, e := range encs {
+		enc := verifyEncodingName(string(e))
+		if enc == "" || enc == All {
+			return nil, fmt.Errorf("unknown encoding %s in server preference", e)
+		}
+		if _, ok := preference[enc]; !ok {
+			preference[enc] = len(preference)
+		}
+	}
+	return preference, nil
+}
+
+// WithMaxBufferSize sets the max size of the response body buffered for
+// each request before the compression decision is made, the default is
+// DefaultMaxBufferSize. Once the buffer is full, the response is
+// compressed and streamed.
+func WithMaxBufferSize(size int) Option {
+	return func(c *config) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid max buffer size %d", size)
+		}
+		c.maxBufferSize = size
+		return nil
+	}
+}
+
+// WithGzipLevel sets the compression level of gzip, the default is
+// gzip.DefaultCompression. gzip.HuffmanOnly is accepted as well, it only
+// does Huffman encoding without the LZ77 matching, which is much faster
+// but compresses less, for latency sensitive services.
+func WithGzipLevel(level int) Option {
+	return func(c *config) error {
+		if !validGzipLevel(level) {
+			return fmt.Errorf("invalid gzip level %d", level)
+		}
+		c.gzipLevel = level
+		return nil
+	}
+}
+
+// WithGzipLevelFunc selects the gzip level for each request with f, e.g.
+// gzip.BestSpeed for the interactive requests and gzip.BestCompression for
+// the bulk ones. The level set by WithGzipLevel is used if f returns an
+// invalid level.
+func WithGzipLevelFunc(f func(*http.Request) int) Option {
+	return func(c *config) error {
+		c.gzipLevelFunc = f
+		return nil
+	}
+}
+
+// requestLevel returns the level of codec for the request r. deflate uses
+// the gzip level, they are both DEFLATE, and compress has no levels.
+func (c *config) requestLevel(codec *codec, r *http.Request) int {
+	switch codec {
+	case brotliCodec:
+		return DefaultBrotliLevel
+	case zstdCodec:
+		return DefaultZstdLevel
+	case compressCodec:
+		return 0
+	}
+	return c.requestGzipLevel(r)
+}
+
+// requestGzipLevel returns the gzip level for the request r.
+func (c *config) requestGzipLevel(r *http.Request) int {
+	if c.gzipLevelFunc == nil {
+		return c.gzipLevel
+	}
+	level := c.gzipLevelFunc(r)
+	if !validGzipLevel(level) {
+		c.logger.Warnf("Invalid gzip level %d for request %s, the default level %d is used.", level, r.URL, c.gzipLevel)
+		return c.gzipLevel
+	}
+	return level
+}
+
+func validGzipLevel(level int) bool {
+	return level >= gzip.HuffmanOnly && level <= gzip.BestCompression
+}
+
+// WithUserAgentSkip serves identity to the requests whose User-Agent makes
+// skip return true, e.g. some crawlers, regardless of Accept-Encoding.
+func WithUserAgentSkip(skip func(userAgent string) bool) Option {
+	return func(c *config) error {
+		c.userAgentSkip = skip
+		return nil
+	}
+}
+
+// WithAcceptEncodingRewrite negotiates the encoding with the Accept-Encoding
+// returned by rewrite instead of the one of the request, e.g. to strip br
+// for a downstream which can't handle it. rewrite is called with the raw
+// Accept-Encoding, whose lines are joined by commas, which is "" if the
+// request has none, and the request isn't modified. Returning "" for a
+// request without Accept-Encoding keeps it without one, otherwise "" is an
+// empty Accept-Encoding, which only accepts identity.
+func WithAcceptEncodingRewrite(rewrite func(r *http.Request, acceptEncoding string) string) Option {
+	return func(c *config) error {
+		c.acceptEncodingRewrite = rewrite
+		return nil
+	}
+}
+
+// WithBreachGuard serves identity to the requests that make guard return
+// true, regardless of Accept-Encoding. The guard should return true for the
+// responses which may reflect the attacker controlled input alongside a
+// secret, e.g. a CSRF token, which could be recovered from the compressed
+// size by a BREACH attack.
+func WithBreachGuard(guard func(r *http.Request) bool) Option {
+	return func(c *config) error {
+		c.breachGuard = guard
+		return nil
+	}
+}
+
+// WithRequestFilter only negotiates the encoding for the requests that make
+// filter return true, e.g. GET and HEAD requests under /api/. The other
+// requests are passed through as identity, e.g. the streaming uploads.
+func WithRequestFilter(filter func(r *http.Request) bool) Option {
+	return func(c *config) error {
+		c.requestFilter = filter
+		return nil
+	}
+}
+
+// WithBypassQueryParam serves identity to the requests whose query
+// parameter name is true, e.g. "?nocompress=1" to debug the raw responses,
+// whatever Accept-Encoding is. The values are parsed by strconv.ParseBool.
+// It's off by default, the clients shouldn't control the encoding through
+// the URL unless it's wanted.
+func WithBypassQueryParam(name string) Option {
+	return func(c *config) error {
+		if name == "" {
+			return fmt.Errorf("no bypass query parameter")
+		}
+		c.bypassQueryParam = name
+		return nil
+	}
+}
+
+// bypassed reports whether r asks for identity by the bypass query
+// parameter.
+func (c *config) bypassed(r *http.Request) bool {
+	if c.bypassQueryParam == "" || r.URL == nil || r.URL.RawQuery == "" {
+		return false
+	}
+	bypass, err := strconv.ParseBool(r.URL.Query().Get(c.bypassQueryParam))
+	return err == nil && bypass
+}
+
+// WithNotAcceptableBody writes the encodings the handler supports into the
+// body of the 406 Not Acceptable responses, e.g.
+// {"supported":["gzip","identity"]}, for the clients to tell what to
+// accept. The 406 responses have no body by default.
+func WithNotAcceptableBody() Option {
+	return func(c *config) error {
+		c.notAcceptableBody = true
+		return nil
+	}
+}
+
+// WithStrictParsing responds 400 Bad Request to the requests with a
+// malformed Accept-Encoding if strict is true, e.g. "gzip;q=abc", instead of
+// ignoring the malformed elements, which is the default. The unknown
+// encodings aren't malformed, they're still ignored.
+func WithStrictParsing(strict bool) Option {
+	return func(c *config) error {
+		c.strictParsing = strict
+		return nil
+	}
+}
+
+// WithMaxAcceptEncodings parses up to max elements of Accept-Encoding, the
+// rest are ignored, so a huge header can't make the negotiation slow. The
+// default is DefaultMaxAcceptEncodings. The header beyond 4KB is ignored as
+// well.
+func WithMaxAcceptEncodings(max int) Option {
+	return func(c *config) error {
+		if max <= 0 {
+			return fmt.Errorf("invalid max accept encodings %d", max)
+		}
+		c.maxAcceptEncodings = max
+		return nil
+	}
+}
+
+// WithPreferredEncodings sets the fallback chain of encodings that "*" in
+// Accept-Encoding resolves to, the first one which is allowed by the
+// handler and not listed by the client is selected. The listed ones are
+// selected by their own qvalues instead, e.g. "gzip;q=0.1, *;q=0.9"
+// doesn't select gzip at 0.9. The default chain is identity only.
+func WithPreferredEncodings(encs ...EncodingType) Option {
+	return func(c *config) error {
+		if len(encs) == 0 {
+			return fmt.Errorf("no item in preferred encodings")
+		}
+		c.preferred = make([]EncodingType, 0, len(encs))
+		for _, e := range encs {
+			enc := verifyEncodingName(string(e))
+			if enc == "" || enc == All {
+				return fmt.Errorf("unknown encoding %s in preferred encodings", e)
+			}
+			c.preferred = append(c.preferred, enc)
+		}
+		return nil
+	}
+}
+
+// WithPreferredEncoding sets the encoding that "*" in Accept-Encoding
+// resolves to, e.g. gzip to save bandwidth for the clients sending only
+// "*". enc must be implemented by the handler, and it falls back to identity
+// if enc isn't allowed by the handler or is disabled by the client. It's
+// the same as WithPreferredEncodings(enc, Identity), the default is
+// identity.
+func WithPreferredEncoding(enc EncodingType) Option {
+	return func(c *config) error {
+		e := verifyEncodingName(string(enc))
+		if _, ok := c.codec(e); !ok && e != Identity {
+			return fmt.Errorf("unsupported preferred encoding %s", enc)
+		}
+		if e == Identity {
+			return WithPreferredEncodings(Identity)(c)
+		}
+		return WithPreferredEncodings(e, Identity)(c)
+	}
+}
+
+// WithMinSizeFunc sets f returning the min size of body to compress for
+// the Content-Type of the response, the smaller responses are served with
+// identity. e.g. HTML compresses well even when it's small, but a short
+// JSON may not. The body is buffered until the size is reached, up to the
+// max buffer size set by WithMaxBufferSize.
+func WithMinSizeFunc(f func(contentType string) int) Option {
+	return func(c *config) error {
+		c.minSizeFunc = f
+		return nil
+	}
+}
+
+// WithMinSize skips compression for the bodies smaller than size bytes, of
+// any Content-Type. It's the same as WithMinSizeFunc returning size, and
+// they override each other.
+func WithMinSize(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("invalid min size %d", size)
+		}
+		c.minSizeFunc = func(string) int { return size }
+		return nil
+	}
+}
+
+// WithRequireContentType skips compression for the responses whose
+// Content-Type isn't set by the inner handler when the body is first
+// written, instead of compressing by the sniffed Content-Type. The default
+// is false.
+func WithRequireContentType(require bool) Option {
+	return func(c *config) error {
+		c.requireContentType = require
+		return nil
+	}
+}
+
+// WithStackedEncoding compresses the body even if the inner handler has
+// set a Content-Encoding, e.g. a proxy passing an encoded body through.
+// The codec is appended to the Content-Encoding, which lists the codings
+// in the order they are applied. By default such a body isn't compressed.
+func WithStackedEncoding() Option {
+	return func(c *config) error {
+		c.stacked = true
+		return nil
+	}
+}
+
+// WithoutPooling creates a new encoder for each response instead of
+// reusing the pooled ones. It's slower, and meant for the tests which need
+// a fresh writer state.
+func WithoutPooling() Option {
+	return func(c *config) error {
+		c.noPooling = true
+		return nil
+	}
+}
+
+// WithAcceptQFloors sets the min qvalue in Accept-Encoding for each
+// encoding in floors to be selected, e.g. {BR: 0.5} only selects br if the
+// client wants it with a qvalue of at least 0.5. The encodings below their
+// floor are skipped, and the encodings not in floors have no floor.
+func WithAcceptQFloors(floors map[EncodingType]float64) Option {
+	return func(c *config) error {
+		c.qFloors = make(map[EncodingType]float64, len(floors))
+		for e, floor := range floors {
+			enc := verifyEncodingName(string(e))
+			if enc == "" || enc == All {
+				return fmt.Errorf("unknown encoding %s in qvalue floors", e)
+			}
+			if !(floor >= 0 && floor <= 1) {
+				return fmt.Errorf("invalid qvalue floor %v for encoding %s", floor, e)
+			}
+			c.qFloors[enc] = floor
+		}
+		return nil
+	}
+}
+
+// WithNegotiationCache caches the negotiated encodings of up to size
+// distinct Accept-Encoding values, so the common values aren't parsed
+// again. The values longer than the parsed ones aren't cached. The cache
+// hits and misses are counted by WithStats, and logged for each request at
+// debug level.
+func WithNegotiationCache(size int) Option {
+	return func(c *config) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid negotiation cache size %d", size)
+		}
+		c.negotiations = newNegotiationCache(size)
+		return nil
+	}
+}
+
+// NginxCompatible configures the handler to compress like the defaults of
+// the nginx gzip module with "gzip on":
+//
+//   - gzip_comp_level 1: the gzip level is gzip.BestSpeed.
+//   - gzip_min_length 20: the bodies smaller than 20 bytes aren't compressed.
+//   - gzip_types text/html: only text/html is compressed, not even
+//     application/json, which needs WithCompressibleTypes like gzip_types
+//     in nginx.
+//   - gzip_proxied off: the proxied requests, which have a Via header, are
+//     served identity.
+//   - gzip_vary off: no Vary header is added.
+//
+// nginx only compresses with gzip, so the handler should only allow gzip
+// as well. The later options override the ones set by NginxCompatible.
+func NginxCompatible() Option {
+	return func(c *config) error {
+		c.gzipLevel = gzip.BestSpeed
+		c.minSizeFunc = func(string) int { return 20 }
+		c.compressibleTypes = []string{"text/html"}
+		c.proxiedSkip = true
+		c.noVary = true
+		return nil
+	}
+}
+
+// WithEncoderFactory encodes enc with the writers created by factory instead
+// of the built-in ones, e.g. a faster gzip implementation, or implements enc
+// if there is no built-in one, e.g. compress. The writers are
+// closed once the response is written, and flushed if they have a Flush
+// method. The negotiation isn't changed, enc still needs to be allowed
+// by the handler. The response isn't encoded if factory returns an error.
+func WithEncoderFactory(enc EncodingType, factory func(io.Writer) (io.WriteCloser, error)) Option {
+	return func(c *config) error {
+		e := verifyEncodingName(string(enc))
+		if e == "" || e == All || e == Identity {
+			return fmt.Errorf("invalid encoding %s for encoder factory", enc)
+		}
+		if factory == nil {
+			return fmt.Errorf("no encoder factory for encoding %s", enc)
+		}
+		if c.codecs == nil {
+			c.codecs = make(map[EncodingType]*codec)
+		}
+		c.codecs[e] = factoryCodec(e, factory)
+		return nil
+	}
+}
+
+// codec returns the codec of enc, it's false if enc isn't implemented.
+func (c *config) codec(enc EncodingType) (*codec, bool) {
+	if codec, ok := c.codecs[enc]; ok {
+		return codec, true
+	}
+	return implementedCodec(enc)
+}
+
+// WithResponseCache caches the compressed 200 responses of GET requests,
+// keyed by the host, the URL and the encoding, for ttl or the freshness
+// lifetime of the response if it's shorter, which is its s-maxage, max-age
+// or Expires less its Age. Only the responses with one of them, or marked
+// public by Cache-Control, are cached. The responses marked no-store,
+// no-cache or private, setting cookies or varying by other request headers
+// are not cached, neither are the responses to the requests with
+// Authorization or Cookie unless they're marked public, s-maxage or
+// must-revalidate. The conditional and range requests are always served by
+// the inner handler.
+func WithResponseCache(ttl time.Duration) Option {
+	return func(c *config) error {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid response cache ttl %v", ttl)
+		}
+		c.cache = newResponseCache(ttl)
+		return nil
+	}
+}
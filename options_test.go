@@ -0,0 +1,1000 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMatchContentType(t *testing.T) {
+	cases := map[string]bool{
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"Application/JSON;charset=UTF-8":  true,
+		"text/html; charset=utf-8":        true,
+		"text/plain":                      true,
+		"application/javascript":          true,
+		"image/svg+xml":                   true,
+		"image/png":                       false,
+		"image/jpeg":                      false,
+		"application/octet-stream":        false,
+		"":                                false,
+	}
+	for contentType, expected := range cases {
+		if ret := matchContentType(contentType, DefaultCompressibleTypes); ret != expected {
+			t.Fatalf("Content-Type %q should match the default types: %v, but returned %v.", contentType, expected, ret)
+		}
+	}
+
+	types := []string{"text/*", "application/*+json"}
+	if !matchContentType("text/css", types) {
+		t.Fatalf("text/css should match %v.", types)
+	}
+	if matchContentType("application/json", types) {
+		t.Fatalf("application/json should not match %v.", types)
+	}
+	if !matchContentType("image/png", []string{"*/*"}) {
+		t.Fatalf("image/png should match */*.")
+	}
+}
+
+func TestWithCompressibleTypes(t *testing.T) {
+	cfg := &config{}
+	if err := WithCompressibleTypes([]string{" Text/ ", "", "application/json"})(cfg); err != nil {
+		t.Fatalf("No error should be returned, but returned %v.", err)
+	}
+	if len(cfg.compressibleTypes) != 2 || cfg.compressibleTypes[0] != "text/" ||
+		cfg.compressibleTypes[1] != "application/json" {
+		t.Fatalf("The types should be normalized, but got %v.", cfg.compressibleTypes)
+	}
+
+	cfg = &config{}
+	if err := WithCompressibleTypes(nil)(cfg); err != nil {
+		t.Fatalf("No error should be returned, but returned %v.", err)
+	}
+	if len(cfg.compressibleTypes) != len(DefaultCompressibleTypes) {
+		t.Fatalf("The default types should be used for empty types, but got %v.", cfg.compressibleTypes)
+	}
+}
+
+func TestCompressibleTypesHandler(t *testing.T) {
+	contentTypes := map[string]bool{
+		"application/json; charset=utf-8": true,
+		"image/png":                       false,
+	}
+	for contentType, compressed := range contentTypes {
+		ct := contentType
+		typedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte("Hello, world."))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, typedh, WithCompressibleTypes(nil))
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if compressed && w.Header().Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("Content-Type %s should be compressed, but Content-Encoding is %q.",
+				contentType, w.Header().Get("Content-Encoding"))
+		}
+		if !compressed {
+			if w.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("Content-Type %s should not be compressed, but Content-Encoding is %q.",
+					contentType, w.Header().Get("Content-Encoding"))
+			}
+			if w.Body.String() != "Hello, world." {
+				t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", w.Body.String())
+			}
+		}
+	}
+
+	// The Content-Type is sniffed if the inner handler doesn't set it.
+	pngh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\x0D\x0A\x1A\x0A"))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, pngh, WithCompressibleTypes(nil))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("A sniffed image/png should not be compressed, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("The sniffed Content-Type should be image/png, but is %q.", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestCompressibleTypesDefault(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	gzipw := gzip.NewWriter(gzipped)
+	gzipw.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	gzipw.Close()
+	bodies := map[string][]byte{
+		"application/json": bytes.Repeat([]byte(`{"hello": "world"}`), 100),
+		"image/png":        append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), make([]byte, 1000)...),
+		"application/zip":  append([]byte("PK\x03\x04"), make([]byte, 1000)...),
+		// The Content-Type is sniffed as application/x-gzip.
+		"": gzipped.Bytes(),
+	}
+	cases := []struct {
+		name       string
+		opts       []Option
+		compressed map[string]bool
+	}{
+		{"the default", nil, map[string]bool{"application/json": true}},
+		{"*/*", []Option{WithCompressibleTypes([]string{"*/*"})},
+			map[string]bool{"application/json": true, "image/png": true, "application/zip": true, "": true}},
+		{"WithIncompressibleTypes", []Option{WithIncompressibleTypes([]string{"image/"})},
+			map[string]bool{"application/json": true, "application/zip": true, "": true}},
+	}
+	for _, c := range cases {
+		for contentType, body := range bodies {
+			contentType, body := contentType, body
+			typedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if contentType != "" {
+					w.Header().Set("Content-Type", contentType)
+				}
+				w.Write(body)
+			})
+			h, err := EncodingHandler([]EncodingType{GZip}, typedh, c.opts...)
+			if err != nil {
+				t.Fatalf("No error should be returned for a valid encoding.")
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", string(GZip))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if compressed := w.Header().Get("Content-Encoding") == string(GZip); compressed != c.compressed[contentType] {
+				t.Fatalf("Content-Type %q should be compressed with %s: %v, but is %v.",
+					contentType, c.name, c.compressed[contentType], compressed)
+			}
+		}
+	}
+}
+
+func TestCompressibleTypesGzipped(t *testing.T) {
+	// The already gzipped payload without Content-Encoding, e.g. a .gz
+	// download, is sniffed as application/x-gzip.
+	gzipped := &bytes.Buffer{}
+	gzipw := gzip.NewWriter(gzipped)
+	gzipw.Write([]byte("Hello, world."))
+	gzipw.Close()
+	gzh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipped.Bytes())
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, gzh, WithCompressibleTypes(nil))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("A gzipped payload should not be compressed again, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), gzipped.Bytes()) {
+		t.Fatalf("The gzipped payload should be passed through.")
+	}
+}
+
+func TestWithServerPreference(t *testing.T) {
+	cfg := &config{}
+	if err := WithServerPreference(BR, XGZip, GZip)(cfg); err != nil {
+		t.Fatalf("No error should be returned, but returned %v.", err)
+	}
+	if len(cfg.preference) != 2 || cfg.preference[BR] != 0 || cfg.preference[GZip] != 1 {
+		t.Fatalf("The preference should be normalized, but got %v.", cfg.preference)
+	}
+
+	for _, enc := range []EncodingType{"fdsafdsa", All} {
+		if err := WithServerPreference(enc)(&config{}); err == nil {
+			t.Fatalf("An error should be returned for encoding %s.", enc)
+		}
+	}
+}
+
+func TestServerPreferenceSelect(t *testing.T) {
+	supEncs := map[EncodingType]bool{
+		BR:       true,
+		GZip:     true,
+		Identity: true,
+	}
+	cfg := &config{}
+	WithServerPreference(BR, GZip)(cfg)
+
+	cases := map[string]EncodingType{
+		// No qvalues, both are 1.
+		"gzip, br": BR,
+		"br, gzip": BR,
+		// The same explicit qvalues.
+		"gzip;q=0.8, br;q=0.8": BR,
+		// The client qvalue still wins.
+		"gzip, br;q=0.5": GZip,
+		// identity is not in the preference, it's after the preferred ones.
+		"identity, gzip": GZip,
+		"*, identity":    Identity,
+	}
+	for encStr, expected := range cases {
+		encs := newAcceptEncoding()
+		encs.preference = cfg.preference
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		if selected := encs.selectAcceptEncoding(supEncs, r); selected != expected {
+			t.Fatalf("%s should be selected for encoding %s, but returned %s.", expected, encStr, selected)
+		}
+	}
+
+	// Without the server preference, the client order is used.
+	encs := newAcceptEncoding()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip, br")
+	if selected := encs.selectAcceptEncoding(supEncs, r); selected != GZip {
+		t.Fatalf("%s should be selected without server preference, but returned %s.", GZip, selected)
+	}
+}
+
+func TestServerPreferenceHandler(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	})
+	cases := []struct {
+		opts     []Option
+		encStr   string
+		expected EncodingType
+	}{
+		{[]Option{WithServerPreference(BR, GZip)}, "gzip,br", BR},
+		{[]Option{WithServerPreference(GZip, BR)}, "br,gzip", GZip},
+		// The client qvalue still wins.
+		{[]Option{WithServerPreference(BR, GZip)}, "gzip;q=0.9,br;q=0.8", GZip},
+		// The server decides what "*" resolves to.
+		{[]Option{WithServerPreference(BR, GZip), WithPreferredEncoding(BR)}, "*", BR},
+	}
+	for _, c := range cases {
+		h, err := EncodingHandler([]EncodingType{GZip, BR}, bodyh, c.opts...)
+		if err != nil {
+			t.Fatalf("No error should be returned for valid options, but returned %v.", err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", c.encStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if ce := w.Header().Get("Content-Encoding"); ce != string(c.expected) {
+			t.Fatalf("%s should be selected for encoding %s, but returned %s.", c.expected, c.encStr, ce)
+		}
+	}
+}
+
+func TestWithOnEncodingSelected(t *testing.T) {
+	type selection struct {
+		chosen     EncodingType
+		compressed bool
+		written    bool
+	}
+	var selections []selection
+	written := false
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+		written = true
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh,
+		WithOnEncodingSelected(func(r *http.Request, chosen EncodingType, compressed bool) {
+			selections = append(selections, selection{chosen, compressed, written})
+		}))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	cases := map[string]selection{
+		"gzip":         {GZip, true, false},
+		"br":           {Identity, false, false},
+		"identity;q=0": {"", false, false},
+	}
+	for encStr, expected := range cases {
+		selections = nil
+		written = false
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if len(selections) != 1 || selections[0] != expected {
+			t.Fatalf("%v should be selected once for encoding %s, but got %v.", expected, encStr, selections)
+		}
+	}
+
+	if err := WithOnEncodingSelected(nil)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for a nil func.")
+	}
+}
+
+func TestWithDisabledEncodings(t *testing.T) {
+	var disabled atomic.Value
+	disabled.Store(map[EncodingType]bool{})
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	for _, opts := range [][]Option{nil, {WithNegotiationCache(16)}} {
+		h, err := EncodingHandler([]EncodingType{BR, GZip}, bodyh, append(opts,
+			WithDisabledEncodings(func() map[EncodingType]bool {
+				return disabled.Load().(map[EncodingType]bool)
+			}))...)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		for _, c := range []struct {
+			disabled map[EncodingType]bool
+			encStr   string
+			ce       string
+		}{
+			{map[EncodingType]bool{}, "br, gzip", string(BR)},
+			{map[EncodingType]bool{BR: true}, "br, gzip", string(GZip)},
+			{map[EncodingType]bool{BR: true, GZip: true}, "br, gzip", ""},
+			{map[EncodingType]bool{BR: false}, "br, gzip", string(BR)},
+		} {
+			disabled.Store(c.disabled)
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", c.encStr)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != c.ce {
+				t.Fatalf("%q should be selected for %s with %v disabled, but status is %d and Content-Encoding is %q.",
+					c.ce, c.encStr, c.disabled, w.Code, w.Header().Get("Content-Encoding"))
+			}
+		}
+	}
+
+	if err := WithDisabledEncodings(nil)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for a nil func.")
+	}
+}
+
+func TestWithRequestFilter(t *testing.T) {
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithRequestFilter(func(r *http.Request) bool {
+		return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(r.URL.Path, "/api/")
+	}))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	cases := []struct {
+		method, path, ce string
+	}{
+		{http.MethodGet, "/api/items", string(GZip)},
+		{http.MethodPost, "/api/items", ""},
+		{http.MethodGet, "/upload", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "http://localhost"+c.path, nil)
+		r.Header.Add("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != c.ce {
+			t.Fatalf("Content-Encoding should be %q for %s %s, but status is %d and Content-Encoding is %q.",
+				c.ce, c.method, c.path, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestWithStrictParsing(t *testing.T) {
+	cases := []struct {
+		encStr  string
+		lenient int
+		strict  int
+	}{
+		{"gzip;q=abc", http.StatusOK, http.StatusBadRequest},
+		{"gzip;q=0.5;q=1", http.StatusOK, http.StatusBadRequest},
+		{"gzip, ;q=1", http.StatusOK, http.StatusBadRequest},
+		{"g(zip)", http.StatusOK, http.StatusBadRequest},
+		// The unknown encodings and the empty elements aren't malformed.
+		{"fdsafdsa, gzip", http.StatusOK, http.StatusOK},
+		{"gzip, , br", http.StatusOK, http.StatusOK},
+		{"gzip;q=0.5, identity;q=0", http.StatusOK, http.StatusOK},
+	}
+	lenient, err := EncodingHandler([]EncodingType{GZip}, origh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	strict, err := EncodingHandler([]EncodingType{GZip}, origh, WithStrictParsing(true))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for _, c := range cases {
+		for h, status := range map[http.Handler]int{lenient: c.lenient, strict: c.strict} {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", c.encStr)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != status {
+				t.Fatalf("Status %d should be returned for %q, but returned %d.", status, c.encStr, w.Code)
+			}
+			if _, dryStatus, _ := h.(*Handler).DryRun(r); dryStatus != status {
+				t.Fatalf("DryRun should return %d for %q, but returned %d.", status, c.encStr, dryStatus)
+			}
+		}
+	}
+}
+
+func TestWithMaxBufferSize(t *testing.T) {
+	cfg := newConfig()
+	if cfg.maxBufferSize != DefaultMaxBufferSize {
+		t.Fatalf("The default max buffer size should be %d, but is %d.", DefaultMaxBufferSize, cfg.maxBufferSize)
+	}
+	if err := WithMaxBufferSize(1024)(cfg); err != nil || cfg.maxBufferSize != 1024 {
+		t.Fatalf("The max buffer size should be set to 1024, but is %d with error %v.", cfg.maxBufferSize, err)
+	}
+	for _, size := range []int{0, -1} {
+		if err := WithMaxBufferSize(size)(cfg); err == nil {
+			t.Fatalf("An error should be returned for max buffer size %d.", size)
+		}
+	}
+}
+
+func TestWithGzipLevel(t *testing.T) {
+	cfg := newConfig()
+	if cfg.gzipLevel != gzip.DefaultCompression {
+		t.Fatalf("The default gzip level should be %d, but is %d.", gzip.DefaultCompression, cfg.gzipLevel)
+	}
+	for _, level := range []int{gzip.HuffmanOnly, gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression} {
+		if err := WithGzipLevel(level)(cfg); err != nil || cfg.gzipLevel != level {
+			t.Fatalf("The gzip level should be set to %d, but is %d with error %v.", level, cfg.gzipLevel, err)
+		}
+	}
+	for _, level := range []int{gzip.HuffmanOnly - 1, gzip.BestCompression + 1} {
+		if err := WithGzipLevel(level)(cfg); err == nil {
+			t.Fatalf("An error should be returned for gzip level %d.", level)
+		}
+	}
+	if _, err := EncodingHandler([]EncodingType{GZip}, origh, WithGzipLevel(100)); err == nil {
+		t.Fatalf("An error should be returned for an invalid gzip level.")
+	}
+}
+
+func TestGzipLevelSize(t *testing.T) {
+	// The body is compressible, but not trivially.
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "%d: Hello, world %d.\n", i, i*i%97)
+	}
+	body := sb.String()
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	})
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithGzipLevel(level))
+		if err != nil {
+			t.Fatalf("No error should be returned for gzip level %d.", level)
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		sizes[level] = w.Body.Len()
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Fatalf("The body of gzip level %d should be smaller than the one of level %d, but the sizes are %v.",
+			gzip.BestCompression, gzip.BestSpeed, sizes)
+	}
+}
+
+func TestRequestGzipLevel(t *testing.T) {
+	cfg := newConfig()
+	WithGzipLevel(gzip.BestSpeed)(cfg)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	if level := cfg.requestGzipLevel(r); level != gzip.BestSpeed {
+		t.Fatalf("The gzip level should be %d without level func, but is %d.", gzip.BestSpeed, level)
+	}
+
+	for level, expected := range map[int]int{
+		gzip.BestCompression: gzip.BestCompression,
+		gzip.HuffmanOnly:     gzip.HuffmanOnly,
+		100:                  gzip.BestSpeed,
+		-100:                 gzip.BestSpeed,
+	} {
+		l := level
+		WithGzipLevelFunc(func(*http.Request) int { return l })(cfg)
+		if ret := cfg.requestGzipLevel(r); ret != expected {
+			t.Fatalf("The gzip level should be %d for returned level %d, but is %d.", expected, level, ret)
+		}
+	}
+}
+
+func TestWithPreferredEncodings(t *testing.T) {
+	cfg := newConfig()
+	if len(cfg.preferred) != 1 || cfg.preferred[0] != Identity {
+		t.Fatalf("The default preferred encodings should be [identity], but is %v.", cfg.preferred)
+	}
+	if err := WithPreferredEncodings(BR, XGZip, Identity)(cfg); err != nil {
+		t.Fatalf("No error should be returned, but returned %v.", err)
+	}
+	if len(cfg.preferred) != 3 || cfg.preferred[0] != BR || cfg.preferred[1] != GZip || cfg.preferred[2] != Identity {
+		t.Fatalf("The preferred encodings should be [br gzip identity], but is %v.", cfg.preferred)
+	}
+	for _, encs := range [][]EncodingType{nil, {"fdsafdsa"}, {GZip, All}} {
+		if err := WithPreferredEncodings(encs...)(newConfig()); err == nil {
+			t.Fatalf("An error should be returned for preferred encodings %v.", encs)
+		}
+	}
+}
+
+func TestWithPreferredEncoding(t *testing.T) {
+	for _, enc := range []EncodingType{"fdsafdsa", All, EXI, AES128GCM} {
+		if err := WithPreferredEncoding(enc)(newConfig()); err == nil {
+			t.Fatalf("An error should be returned for the preferred encoding %s.", enc)
+		}
+	}
+
+	cases := map[EncodingType]string{
+		"":       "",
+		Identity: "",
+		GZip:     "gzip",
+		XGZip:    "gzip",
+	}
+	for enc, ce := range cases {
+		var opts []Option
+		if enc != "" {
+			opts = append(opts, WithPreferredEncoding(enc))
+		}
+		h, err := EncodingHandler([]EncodingType{GZip, Identity}, origh, opts...)
+		if err != nil {
+			t.Fatalf("No error should be returned for the preferred encoding %q, but returned %v.", enc, err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", "*")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != ce {
+			t.Fatalf("* should resolve to %q with the preferred encoding %q, but Content-Encoding is %q.",
+				ce, enc, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	// It falls back to identity if gzip isn't allowed.
+	h, err := EncodingHandler([]EncodingType{Identity}, origh, WithPreferredEncoding(GZip))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "*")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("* should fall back to identity, but status is %d and Content-Encoding is %q.",
+			w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestPreferredEncodingsSelect(t *testing.T) {
+	supEncs := map[EncodingType]bool{
+		BR:       true,
+		GZip:     true,
+		Identity: true,
+	}
+	cfg := newConfig()
+	WithPreferredEncodings(BR, GZip, Identity)(cfg)
+
+	cases := map[string]EncodingType{
+		"*":                                 BR,
+		"*, br;q=0":                         GZip,
+		"*, br;q=0, gzip;q=0":               Identity,
+		"deflate, *;q=0.5, br;q=0":          GZip,
+		"*;q=0.5, identity;q=0.8":           Identity,
+		"*, br;q=0, x-gzip;q=0":             Identity,
+		"*, br;q=0, gzip;q=0, identity;q=0": "",
+	}
+	for encStr, expected := range cases {
+		encs := newAcceptEncoding()
+		encs.preferred = cfg.preferred
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		if selected := encs.selectAcceptEncoding(supEncs, r); selected != expected {
+			t.Fatalf("%q should be selected for encoding %s, but returned %q.", expected, encStr, selected)
+		}
+	}
+
+	// The unsupported ones in the chain are skipped.
+	encs := newAcceptEncoding()
+	encs.preferred = cfg.preferred
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "*")
+	if selected := encs.selectAcceptEncoding(map[EncodingType]bool{GZip: true}, r); selected != GZip {
+		t.Fatalf("%s should be selected for unsupported br, but returned %s.", GZip, selected)
+	}
+}
+
+func TestIncompressibleTypesHandler(t *testing.T) {
+	contentTypes := map[string]bool{
+		"application/json": true,
+		"image/png":        false,
+		"video/mp4":        false,
+	}
+	for contentType, compressed := range contentTypes {
+		ct := contentType
+		typedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.Write([]byte("Hello, world."))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, typedh, WithIncompressibleTypes([]string{"image/", "video/*"}))
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if (w.Header().Get("Content-Encoding") == string(GZip)) != compressed {
+			t.Fatalf("Content-Type %s should be compressed: %v, but Content-Encoding is %q.",
+				contentType, compressed, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestConflictingTypesOptions(t *testing.T) {
+	_, err := EncodingHandler([]EncodingType{GZip}, origh,
+		WithCompressibleTypes(nil), WithIncompressibleTypes([]string{"image/png"}))
+	if err == nil {
+		t.Fatalf("An error should be returned for both allowlist and denylist of types.")
+	}
+	if err.Error() != "WithCompressibleTypes and WithIncompressibleTypes can't be used together" {
+		t.Fatalf("The error should describe the conflicting options, but is [%s].", err.Error())
+	}
+}
+
+func TestDefaultServerPreference(t *testing.T) {
+	cfg := newConfig()
+	cases := []struct {
+		supported []EncodingType
+		expected  EncodingType
+	}{
+		{[]EncodingType{GZip, Deflate, BR, ZStd, Identity}, BR},
+		{[]EncodingType{GZip, Deflate, ZStd, Identity}, ZStd},
+		{[]EncodingType{Deflate, GZip, Identity}, GZip},
+		{[]EncodingType{Identity, Deflate}, Deflate},
+		{[]EncodingType{Identity}, Identity},
+	}
+	for _, c := range cases {
+		supEncs := make(map[EncodingType]bool)
+		for _, enc := range c.supported {
+			supEncs[enc] = true
+		}
+		encs := newAcceptEncoding()
+		encs.preference = cfg.preference
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		// The canonical browser header.
+		r.Header.Add("Accept-Encoding", "gzip, deflate, br, zstd")
+		if selected := encs.negotiate(supEncs, r); selected != c.expected {
+			t.Fatalf("%s should be selected by default for %v, but returned %s.", c.expected, c.supported, selected)
+		}
+	}
+}
+
+func TestWithAcceptQFloors(t *testing.T) {
+	cfg := &config{}
+	if err := WithAcceptQFloors(map[EncodingType]float64{BR: 0.5, XGZip: 0.1})(cfg); err != nil {
+		t.Fatalf("No error should be returned, but returned %v.", err)
+	}
+	if len(cfg.qFloors) != 2 || cfg.qFloors[BR] != 0.5 || cfg.qFloors[GZip] != 0.1 {
+		t.Fatalf("The qvalue floors should be normalized, but got %v.", cfg.qFloors)
+	}
+	invalids := []map[EncodingType]float64{
+		{"fdsafdsa": 0.5},
+		{All: 0.5},
+		{BR: -0.1},
+		{BR: 1.1},
+	}
+	for _, floors := range invalids {
+		if err := WithAcceptQFloors(floors)(&config{}); err == nil {
+			t.Fatalf("An error should be returned for qvalue floors %v.", floors)
+		}
+	}
+}
+
+func TestAcceptQFloorsSelect(t *testing.T) {
+	supEncs := map[EncodingType]bool{
+		BR:       true,
+		GZip:     true,
+		Identity: true,
+	}
+	cfg := &config{}
+	WithAcceptQFloors(map[EncodingType]float64{BR: 0.5})(cfg)
+
+	cases := map[string]EncodingType{
+		// br is below its floor, gzip has no floor.
+		"br;q=0.3, gzip;q=0.3": GZip,
+		"br;q=0.3, gzip;q=0.2": GZip,
+		"br;q=0.5, gzip;q=0.3": BR,
+		"br, gzip":             BR,
+		// br is the only one, identity is the fallback.
+		"br;q=0.3": Identity,
+	}
+	for encStr, expected := range cases {
+		encs := newAcceptEncoding()
+		encs.qFloors = cfg.qFloors
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", encStr)
+		if selected := encs.negotiate(supEncs, r); selected != expected {
+			t.Fatalf("%s should be selected for encoding %s, but returned %s.", expected, encStr, selected)
+		}
+	}
+}
+
+func TestNginxCompatible(t *testing.T) {
+	cases := []struct {
+		contentType string
+		body        string
+		via         string
+		compressed  bool
+	}{
+		// Too small.
+		{"text/html", "Hello, world.", "", false},
+		{"text/html; charset=utf-8", strings.Repeat("Hello, world.", 10), "", true},
+		// Only text/html is compressed by default, the default gzip_types
+		// of nginx excludes JSON.
+		{"application/json", strings.Repeat(`{"hello": "world"}`, 100), "", false},
+		{"text/css", strings.Repeat("Hello, world.", 10), "", false},
+		// Proxied.
+		{"text/html", strings.Repeat("Hello, world.", 10), "1.1 proxy", false},
+	}
+	for _, c := range cases {
+		c := c
+		typedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", c.contentType)
+			w.Write([]byte(c.body))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, typedh, NginxCompatible())
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		if c.via != "" {
+			r.Header.Set("Via", c.via)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if compressed := w.Header().Get("Content-Encoding") == string(GZip); compressed != c.compressed {
+			t.Fatalf("The %d bytes of %s with Via %q should be compressed: %v, but is %v.",
+				len(c.body), c.contentType, c.via, c.compressed, compressed)
+		}
+		if _, ok := w.Header()["Vary"]; ok {
+			t.Fatalf("No Vary should be added, but is %v.", w.Header()["Vary"])
+		}
+	}
+
+	// The large JSON is compressed once its type is configured, like
+	// gzip_types.
+	jsonh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Repeat(`{"hello": "world"}`, 100)))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, jsonh, NginxCompatible(),
+		WithCompressibleTypes([]string{"text/html", "application/json"}))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("The large JSON should be compressed, but Content-Encoding is %q.", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestWithForcedEncoding(t *testing.T) {
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	h, err := EncodingHandler([]EncodingType{BR, GZip, Identity}, bodyh, WithForcedEncoding(GZip))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for _, c := range []struct {
+		encStr []string
+		ce     string
+	}{
+		{nil, string(GZip)},
+		{[]string{""}, string(GZip)},
+		{[]string{"identity"}, string(GZip)},
+		{[]string{"br"}, string(GZip)},
+		{[]string{"gzip;q=0, br"}, string(BR)},
+		{[]string{"*;q=0, br"}, string(BR)},
+		{[]string{"*;q=0, gzip;q=0.5"}, string(GZip)},
+		{[]string{"gzip;q=0"}, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		for _, v := range c.encStr {
+			r.Header.Add("Accept-Encoding", v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != c.ce {
+			t.Fatalf("%q should be applied for %q, but status is %d and Content-Encoding is %q.",
+				c.ce, c.encStr, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	for _, enc := range []EncodingType{Identity, EXI, "unknown"} {
+		if _, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithForcedEncoding(enc)); err == nil {
+			t.Fatalf("An error should be returned for the forced encoding %q.", enc)
+		}
+	}
+}
+
+func TestWithCacheVariantHeader(t *testing.T) {
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/br" {
+			w.Header().Set("Content-Encoding", "br")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	for _, c := range []struct {
+		allowed []EncodingType
+		path    string
+		encStr  string
+		variant string
+	}{
+		{[]EncodingType{GZip, Identity}, "/", "gzip", "gzip"},
+		{[]EncodingType{GZip, Identity}, "/", "identity", "identity"},
+		{[]EncodingType{GZip, Identity}, "/", "br", "identity"},
+		{[]EncodingType{GZip, Identity}, "/br", "gzip", "br"},
+		{[]EncodingType{Identity}, "/", "gzip", "identity"},
+		{[]EncodingType{GZip}, "/", "gzip;q=0, identity;q=0", ""},
+	} {
+		h, err := EncodingHandler(c.allowed, bodyh, WithCacheVariantHeader("X-Cache-Variant"))
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost"+c.path, nil)
+		r.Header.Add("Accept-Encoding", c.encStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if variant := w.Header().Get("X-Cache-Variant"); variant != c.variant {
+			t.Fatalf("The variant of %s for %q should be %q, but is %q.", c.path, c.encStr, c.variant, variant)
+		}
+	}
+
+	for _, name := range []string{"", "X Variant", "X-Variant:"} {
+		if err := WithCacheVariantHeader(name)(newConfig()); err == nil {
+			t.Fatalf("An error should be returned for the header name %q.", name)
+		}
+	}
+}
+
+func TestWithLegacyEncodingNames(t *testing.T) {
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "public")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	legacy, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithLegacyEncodingNames(), WithResponseCache(time.Minute))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	plain, err := EncodingHandler([]EncodingType{GZip}, bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for _, c := range []struct {
+		h      http.Handler
+		encStr string
+		ce     string
+	}{
+		{legacy, "x-gzip", "x-gzip"},
+		{legacy, "gzip", "gzip"},
+		// The cached x-gzip response isn't served to the others.
+		{legacy, "X-GZIP;q=0.5", "x-gzip"},
+		{legacy, "x-gzip, gzip", "gzip"},
+		{legacy, "br, x-gzip", "x-gzip"},
+		{plain, "x-gzip", "gzip"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", c.encStr)
+		w := httptest.NewRecorder()
+		c.h.ServeHTTP(w, r)
+		if ce := w.Header().Get("Content-Encoding"); ce != c.ce {
+			t.Fatalf("Content-Encoding should be %q for %q, but is %q.", c.ce, c.encStr, ce)
+		}
+		gzipr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("The body should be gzip for %q, but returned %v.", c.encStr, err)
+		}
+		gzipr.Close()
+	}
+}
+
+func TestWithBypassQueryParam(t *testing.T) {
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithBypassQueryParam("nocompress"))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	plain, err := EncodingHandler([]EncodingType{GZip}, bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for _, c := range []struct {
+		h     http.Handler
+		query string
+		ce    string
+	}{
+		{h, "?nocompress=1", ""},
+		{h, "?a=b&nocompress=true", ""},
+		{h, "?nocompress=0", "gzip"},
+		{h, "?nocompress=", "gzip"},
+		{h, "?nocompress=yes", "gzip"},
+		{h, "?compress=1", "gzip"},
+		{h, "", "gzip"},
+		// It's off by default.
+		{plain, "?nocompress=1", "gzip"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/"+c.query, nil)
+		r.Header.Add("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		c.h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != c.ce {
+			t.Fatalf("%q should be served for %q, but status is %d and Content-Encoding is %q.",
+				c.ce, c.query, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	if err := WithBypassQueryParam("")(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for an empty name.")
+	}
+}
+
+func TestWithNotAcceptableBody(t *testing.T) {
+	for _, c := range []struct {
+		opts []Option
+		body string
+	}{
+		{nil, ""},
+		{[]Option{WithNotAcceptableBody()}, `{"supported":["br","gzip","identity"]}`},
+	} {
+		h, err := EncodingHandler([]EncodingType{GZip, BR, EXI}, origh, c.opts...)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", "zstd, identity;q=0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNotAcceptable {
+			t.Fatalf("Status %d should be returned, but returned %d.", http.StatusNotAcceptable, w.Code)
+		}
+		if w.Body.String() != c.body {
+			t.Fatalf("The body should be %q, but is %q.", c.body, w.Body.String())
+		}
+		if c.body != "" && w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("The body should be JSON, but Content-Type is %q.", w.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+
+package handler
+
+func init() {
+	// The race detector allocates, the allocation tests are skipped.
+	raceEnabled = true
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Statistics is a snapshot of the package level compression counters,
+// which are updated by the handlers created with WithStats.
+type Statistics struct {
+	// UncompressedBytes is the total size of the compressed responses
+	// before compression.
+	UncompressedBytes uint64
+	// CompressedBytes is the total size of the compressed responses
+	// after compression.
+	CompressedBytes uint64
+	// Encodings is the number of responses served with each encoding.
+	Encodings map[EncodingType]uint64
+	// NegotiationCacheHits and NegotiationCacheMisses are the number of
+	// encodings negotiated with WithNegotiationCache which are found in
+	// the cache and which aren't.
+	NegotiationCacheHits   uint64
+	NegotiationCacheMisses uint64
+}
+
+// CompressionStats is the sizes of a compressed response.
+type CompressionStats struct {
+	Encoding EncodingType
+	// UncompressedBytes is the size of the body written by the inner
+	// handler, and CompressedBytes is the size written to the client.
+	UncompressedBytes uint64
+	CompressedBytes   uint64
+}
+
+// Ratio returns the compressed size to the uncompressed size, it's 0 for
+// an empty body.
+func (s CompressionStats) Ratio() float64 {
+	if s.UncompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+}
+
+var (
+	uncompressedBytes      uint64
+	compressedBytes        uint64
+	negotiationCacheHits   uint64
+	negotiationCacheMisses uint64
+	// encodingCounts maps EncodingType to *uint64
+	encodingCounts sync.Map
+)
+
+// Stats returns a snapshot of the compression counters.
+func Stats() Statistics {
+	s := Statistics{
+		UncompressedBytes:      atomic.LoadUint64(&uncompressedBytes),
+		CompressedBytes:        atomic.LoadUint64(&compressedBytes),
+		Encodings:              make(map[EncodingType]uint64),
+		NegotiationCacheHits:   atomic.LoadUint64(&negotiationCacheHits),
+		NegotiationCacheMisses: atomic.LoadUint64(&negotiationCacheMisses),
+	}
+	encodingCounts.Range(func(key, value interface{}) bool {
+		s.Encodings[key.(EncodingType)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return s
+}
+
+func countEncoding(enc EncodingType) {
+	counter, ok := encodingCounts.Load(enc)
+	if !ok {
+		counter, _ = encodingCounts.LoadOrStore(enc, new(uint64))
+	}
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+func countBytes(uncompressed, compressed uint64) {
+	atomic.AddUint64(&uncompressedBytes, uncompressed)
+	atomic.AddUint64(&compressedBytes, compressed)
+}
+
+func countNegotiation(hit bool) {
+	if hit {
+		atomic.AddUint64(&negotiationCacheHits, 1)
+	} else {
+		atomic.AddUint64(&negotiationCacheMisses, 1)
+	}
+}
+
+// countingWriter counts the bytes written to w. It also keeps the first
+// error returned by w, and doesn't write to w anymore after that.
+type countingWriter struct {
+	w   io.Writer
+	n   uint64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += uint64(n)
+	c.err = err
+	return n, err
+}
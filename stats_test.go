@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, bodyh, WithStats())
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	before := Stats()
+	compressedSize := 0
+	for _, enc := range []string{"gzip", "gzip", "identity"} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", enc)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if enc == "gzip" {
+			compressedSize += w.Body.Len()
+		}
+	}
+	after := Stats()
+
+	if after.Encodings[GZip]-before.Encodings[GZip] != 2 {
+		t.Fatalf("2 gzip responses should be counted, but counted %d.",
+			after.Encodings[GZip]-before.Encodings[GZip])
+	}
+	if after.Encodings[Identity]-before.Encodings[Identity] != 1 {
+		t.Fatalf("1 identity response should be counted, but counted %d.",
+			after.Encodings[Identity]-before.Encodings[Identity])
+	}
+	if after.UncompressedBytes-before.UncompressedBytes != uint64(2*len(body)) {
+		t.Fatalf("%d uncompressed bytes should be counted, but counted %d.",
+			2*len(body), after.UncompressedBytes-before.UncompressedBytes)
+	}
+	if after.CompressedBytes-before.CompressedBytes != uint64(compressedSize) {
+		t.Fatalf("%d compressed bytes should be counted, but counted %d.",
+			compressedSize, after.CompressedBytes-before.CompressedBytes)
+	}
+
+	// The handler without WithStats doesn't update the counters.
+	h, err = EncodingHandler([]EncodingType{GZip}, bodyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if Stats().Encodings[GZip] != after.Encodings[GZip] {
+		t.Fatalf("The counters should not be updated without WithStats.")
+	}
+}
+
+func TestWithCompressionStats(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	var stats []CompressionStats
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, bodyh,
+		WithCompressionStats(func(r *http.Request, s CompressionStats) {
+			stats = append(stats, s)
+		}))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if len(stats) != 1 {
+		t.Fatalf("The stats should be reported once, but reported %d times.", len(stats))
+	}
+	s := stats[0]
+	if s.Encoding != GZip || s.UncompressedBytes != uint64(len(body)) || s.CompressedBytes != uint64(w.Body.Len()) {
+		t.Fatalf("The stats should be {%s %d %d}, but are %v.", GZip, len(body), w.Body.Len(), s)
+	}
+	if s.Ratio() >= 0.5 {
+		t.Fatalf("The ratio of the repetitive body should be well below 1, but is %v.", s.Ratio())
+	}
+
+	// The identity responses aren't reported.
+	r = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "identity")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if len(stats) != 1 {
+		t.Fatalf("The identity response should not be reported.")
+	}
+
+	if (CompressionStats{}).Ratio() != 0 {
+		t.Fatalf("The ratio of an empty body should be 0.")
+	}
+	if err := WithCompressionStats(nil)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for a nil func.")
+	}
+}
@@ -0,0 +1,744 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadlineMargin is the remaining time of a request deadline under which
+// the compression degrades. A request with less time left is served without
+// compression, and a compressing response pushes its data to the client on
+// every write instead of keeping it in the compressor.
+const deadlineMargin = 10 * time.Millisecond
+
+// sniffLen is the number of bytes used by http.DetectContentType.
+const sniffLen = 512
+
+// encodingWriter decides whether to compress the response when the first
+// body bytes are written, once the headers set by the inner handler
+// are known.
+type encodingWriter struct {
+	httpw http.ResponseWriter
+	req   *http.Request
+	codec *codec
+	// coding is the name of the codec in Content-Encoding, e.g. x-gzip
+	// for the legacy clients.
+	coding EncodingType
+	encw   encoder
+	cfg    *config
+	// level is the codec level of the request.
+	level int
+
+	// deadline is the deadline of the request context, it's zero
+	// if the request has no deadline.
+	deadline time.Time
+
+	wroteHeader bool
+	statusCode  int
+	// calledWriteHeader is true once the inner handler has called
+	// WriteHeader with a final status.
+	calledWriteHeader bool
+	// head is true for the HEAD requests, whose headers are negotiated as
+	// for GET, but no encoded body is written.
+	head bool
+	// decided is true once the compression decision has been made
+	// and the header has been passed to httpw.
+	decided  bool
+	compress bool
+
+	// in is the number of bytes passed to encw, and out counts the
+	// bytes encw emitted, they are used by the stats.
+	in  uint64
+	out *countingWriter
+
+	// buf holds the body written before the decision.
+	buf []byte
+	// scratch is reused by WriteString to pass the strings to encw.
+	scratch []byte
+
+	// cacheKey is the key to store the compressed response into the
+	// cache, it's empty if the response isn't cacheable.
+	cacheKey string
+	capture  *captureWriter
+}
+
+func (ew *encodingWriter) Write(b []byte) (int, error) {
+	if err := ew.req.Context().Err(); err == context.Canceled {
+		// The client is gone, stop compressing for nothing, so the inner
+		// handler can abort. The exceeded deadline is handled by
+		// writeBody, which flushes what it has.
+		return 0, err
+	}
+	if !ew.decided {
+		if !ew.wroteHeader {
+			ew.wroteHeader = true
+			ew.statusCode = http.StatusOK
+		}
+		if ew.sniffable() && len(ew.buf)+len(b) >= ew.bufferSize() {
+			// Enough data for sniffing, then the Content-Type decides
+			// how much more data is needed.
+			ew.sniff(head(ew.buf, b))
+		}
+		if len(ew.buf)+len(b) < ew.bufferSize() {
+			// Not enough data to decide yet.
+			ew.buf = append(ew.buf, b...)
+			return len(b), nil
+		}
+		ew.decide(head(ew.buf, b), false)
+		if err := ew.writeBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	return ew.writeBody(b)
+}
+
+// WriteString implements io.StringWriter, s isn't copied into a new []byte
+// for each call. It's passed to the underlying writer as it is if the
+// response isn't encoded, and to the encoder through a reused buffer
+// otherwise.
+func (ew *encodingWriter) WriteString(s string) (int, error) {
+	if err := ew.req.Context().Err(); err == context.Canceled {
+		return 0, err
+	}
+	if !ew.decided {
+		if len(ew.buf)+len(s) >= ew.bufferSize() {
+			return ew.Write([]byte(s))
+		}
+		if !ew.wroteHeader {
+			ew.wroteHeader = true
+			ew.statusCode = http.StatusOK
+		}
+		// Not enough data to decide yet.
+		ew.buf = append(ew.buf, s...)
+		return len(s), nil
+	}
+	if !ew.compress {
+		return io.WriteString(ew.httpw, s)
+	}
+	if ew.scratch == nil {
+		ew.scratch = make([]byte, 512)
+	}
+	written := 0
+	for written < len(s) {
+		// The encoders copy what is written, the buffer can be reused.
+		n, err := ew.writeBody(ew.scratch[:copy(ew.scratch, s[written:])])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writeBody writes b after the decision has been made.
+func (ew *encodingWriter) writeBody(b []byte) (int, error) {
+	if !ew.compress {
+		return ew.httpw.Write(b)
+	}
+	if ew.head {
+		// The body of HEAD is discarded, don't encode it for nothing.
+		return len(b), nil
+	}
+
+	if ew.deadline.IsZero() {
+		return ew.write(b)
+	}
+
+	remaining := ew.deadline.Sub(timeNow())
+	if remaining <= 0 {
+		// The deadline is exceeded, flush what we have and stop
+		// compressing, so the inner handler can abort.
+		ew.flush()
+		return 0, context.DeadlineExceeded
+	}
+	n, err := ew.write(b)
+	if err == nil && remaining < deadlineMargin {
+		// The deadline is near, don't keep the data in the compressor.
+		err = ew.flush()
+	}
+	return n, err
+}
+
+// writeBuffer writes the body buffered before the decision.
+func (ew *encodingWriter) writeBuffer() error {
+	if len(ew.buf) == 0 {
+		return nil
+	}
+	_, err := ew.writeBody(ew.buf)
+	ew.buf = nil
+	return err
+}
+
+// bufferSize returns how many bytes of body are needed for the decision.
+func (ew *encodingWriter) bufferSize() int {
+	if !ew.deadline.IsZero() && ew.deadline.Sub(timeNow()) < deadlineMargin {
+		// No time to wait for more data.
+		return 0
+	}
+	size := 0
+	if ew.sniffable() {
+		size = sniffLen
+	} else if contentType := ew.Header().Get("Content-Type"); contentType != "" {
+		size = ew.minSize(contentType)
+	}
+	if size > ew.cfg.maxBufferSize {
+		// Commit to compression, which is the default, once the buffer
+		// is full.
+		size = ew.cfg.maxBufferSize
+	}
+	return size
+}
+
+// minSize returns the min size of body to compress for contentType.
+func (ew *encodingWriter) minSize(contentType string) int {
+	if ew.cfg.minSizeFunc == nil {
+		return 0
+	}
+	return ew.cfg.minSizeFunc(contentType)
+}
+
+// sniffable reports whether the Content-Type should be sniffed from the
+// body before the decision.
+func (ew *encodingWriter) sniffable() bool {
+	// The identity body is sniffed by net/http if Content-Type is required.
+	return ew.Header().Get("Content-Type") == "" && !encoded(ew.Header()) && !ew.cfg.requireContentType
+}
+
+// sniff sets the Content-Type sniffed from the first body bytes b. It's
+// the same as net/http, but the compressed body can't be sniffed by
+// net/http, so it's set here.
+func (ew *encodingWriter) sniff(b []byte) {
+	ew.Header().Set("Content-Type", http.DetectContentType(b))
+}
+
+// head returns the leading bytes of the body for sniffing, the body
+// starts with the buffered buf and is followed by b.
+func head(buf, b []byte) []byte {
+	if len(buf) == 0 {
+		return b
+	}
+	if len(buf) >= sniffLen {
+		return buf
+	}
+	n := sniffLen - len(buf)
+	if n > len(b) {
+		n = len(b)
+	}
+	// Copy instead of appending to buf, it's written after the decision.
+	return append(buf[:len(buf):len(buf)], b[:n]...)
+}
+
+func (ew *encodingWriter) write(b []byte) (int, error) {
+	if ew.out.err != nil {
+		// The connection is broken, e.g. the client is gone, don't
+		// compress into it anymore.
+		return 0, ew.out.err
+	}
+	n, err := ew.encw.Write(b)
+	ew.in += uint64(n)
+	if err == nil {
+		err = ew.out.err
+	}
+	return n, err
+}
+
+func (ew *encodingWriter) WriteHeader(statusCode int) {
+	if statusCode >= 100 && statusCode <= 199 {
+		// The informational responses are sent before the final one, they
+		// don't have body and don't affect the decision.
+		ew.httpw.WriteHeader(statusCode)
+		return
+	}
+	if ew.calledWriteHeader || ew.decided {
+		// The status has been set, or passed to httpw with the headers
+		// of the decision, the later ones are ignored like net/http does.
+		return
+	}
+	ew.calledWriteHeader = true
+	// The status of a late WriteHeader after some buffered writes is still
+	// pending, it's updated, and the body is written once decided.
+	ew.wroteHeader = true
+	ew.statusCode = statusCode
+	if len(ew.buf) == 0 && (ew.bufferSize() == 0 || !bodyAllowed(statusCode)) {
+		// The decision doesn't depend on the body, no need to wait for it.
+		ew.decide(nil, false)
+	}
+}
+
+func (ew *encodingWriter) Header() http.Header {
+	return ew.httpw.Header()
+}
+
+// decide makes the compression decision with the first body bytes b,
+// and passes the pending header to httpw. whole is true if b is the
+// whole body.
+func (ew *encodingWriter) decide(b []byte, whole bool) {
+	ew.decided = true
+	header := ew.Header()
+	// The inner handler opts out of the encoding by identity, which isn't
+	// sent as it's never a coding of the body.
+	identity := identityEncoded(header)
+	if identity {
+		header.Del("Content-Encoding")
+	}
+	ew.compress = !identity && ew.shouldCompress(b, whole)
+
+	if ew.compress && !ew.head {
+		ew.out = &countingWriter{w: ew.httpw}
+		if ew.cacheKey != "" {
+			ew.capture = &captureWriter{w: ew.httpw}
+			ew.out.w = ew.capture
+		}
+		var err error
+		if ew.cfg.noPooling {
+			ew.encw, err = ew.codec.newEncoder(ew.out, ew.level)
+		} else {
+			ew.encw, err = ew.codec.getEncoder(ew.out, ew.level)
+		}
+		if err != nil {
+			ew.cfg.logger.Errorf("Error %v while creating the %s encoder, the response to %s isn't encoded.",
+				err, ew.codec.encoding, ew.req.URL)
+			ew.compress = false
+		}
+	}
+
+	ew.cfg.selected(ew.req, ew.codec.encoding, ew.compress)
+
+	if ew.compress {
+		if encoded(header) {
+			// The codings are listed in the order they are applied.
+			header.Set("Content-Encoding", strings.Join(header.Values("Content-Encoding"), ", ")+", "+string(ew.coding))
+		} else {
+			header.Set("Content-Encoding", string(ew.coding))
+		}
+		// The length of the compressed body is unknown. HTTP/1.1 uses the
+		// chunked transfer coding then, which is added by net/http.
+		header.Del("Content-Length")
+		if !ew.cfg.noVary {
+			// The inner handler may have replaced the Vary.
+			addVary(header)
+		}
+		if ew.req.ProtoMajor == 2 {
+			// HTTP/2 has its own framing, Transfer-Encoding isn't allowed.
+			header.Del("Transfer-Encoding")
+		} else {
+			clearTransferCodings(header)
+		}
+	}
+	ew.cfg.setVariant(header)
+	if ew.wroteHeader {
+		ew.httpw.WriteHeader(ew.statusCode)
+	}
+}
+
+// shouldCompress reports whether the response should be compressed, b is
+// the first body bytes, or the whole body if whole is true.
+func (ew *encodingWriter) shouldCompress(b []byte, whole bool) bool {
+	if ew.wroteHeader && !bodyAllowed(ew.statusCode) {
+		// No encoding and no empty compressed stream for the responses
+		// without body.
+		return false
+	}
+	header := ew.Header()
+	if encoded(header) {
+		// The inner handler has encoded the body itself, e.g. it serves
+		// a precompressed file, don't encode it again unless asked to.
+		return ew.cfg.stacked
+	}
+	if hasCacheDirective(header, "no-transform") {
+		// https://tools.ietf.org/html/rfc7234#section-5.2.2.4
+		// The response must not be transformed by the intermediaries.
+		return false
+	}
+
+	size := len(b)
+	if ew.head && len(b) == 0 {
+		// The body of HEAD is usually not written, then its size is the
+		// Content-Length of GET if it's set, so the decision is the same.
+		size = contentLength(header)
+	}
+	if whole && size == 0 {
+		// No Content-Encoding and no empty compressed stream for the empty
+		// body, whatever the min size.
+		return false
+	}
+	if ew.sniffable() && !(ew.head && len(b) == 0) {
+		ew.sniff(b)
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" && ew.cfg.requireContentType {
+		return false
+	}
+	if ew.cfg.compressibleTypes != nil && !matchContentType(contentType, ew.cfg.compressibleTypes) {
+		return false
+	}
+	if ew.cfg.incompressibleTypes != nil && matchContentType(contentType, ew.cfg.incompressibleTypes) {
+		return false
+	}
+	if whole && size < ew.minSize(contentType) {
+		// The body is too small to be worth compressing.
+		return false
+	}
+	return true
+}
+
+// contentLength returns the Content-Length of header, it's 0 if it's not
+// set or invalid.
+func contentLength(header http.Header) int {
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// addVary adds Accept-Encoding to the Vary of header, unless it's there.
+func addVary(header http.Header) {
+	values := header.Values("Vary")
+	for _, v := range values {
+		for v != "" {
+			var name string
+			name, v, _ = strings.Cut(v, ",")
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	if len(values) == 0 {
+		header.Set("Vary", "Accept-Encoding")
+		return
+	}
+	header.Set("Vary", strings.Join(values, ", ")+", Accept-Encoding")
+}
+
+// clearTransferCodings removes the compression transfer codings from the
+// Transfer-Encoding, e.g. "gzip, chunked" becomes "chunked", otherwise
+// the client would decode the body twice with the content coding.
+func clearTransferCodings(header http.Header) {
+	values, ok := header["Transfer-Encoding"]
+	if !ok {
+		return
+	}
+	var codings []string
+	for _, v := range values {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.TrimSpace(coding)
+			switch verifyEncodingName(strings.ToLower(coding)) {
+			case "", Identity:
+				// chunked and the unknown codings are kept.
+				if coding != "" {
+					codings = append(codings, coding)
+				}
+			}
+		}
+	}
+	if len(codings) == 0 {
+		header.Del("Transfer-Encoding")
+		return
+	}
+	header.Set("Transfer-Encoding", strings.Join(codings, ", "))
+}
+
+// bodyAllowed reports whether the response of status may have a body.
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// encoded reports whether the body has been encoded by the inner handler.
+func encoded(header http.Header) bool {
+	ce := strings.TrimSpace(header.Get("Content-Encoding"))
+	return ce != "" && !strings.EqualFold(ce, string(Identity))
+}
+
+// identityEncoded reports whether the inner handler sets the
+// Content-Encoding to identity.
+func identityEncoded(header http.Header) bool {
+	values := header.Values("Content-Encoding")
+	return len(values) == 1 && strings.EqualFold(strings.TrimSpace(values[0]), string(Identity))
+}
+
+// identityWriter passes the identity response through to the underlying
+// writer, without the Content-Encoding: identity set by the inner handler.
+type identityWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// identityWriters pools the identityWriters, the identity responses don't
+// allocate.
+var identityWriters = sync.Pool{New: func() interface{} { return new(identityWriter) }}
+
+// serveIdentity serves r by next without encoding the response.
+func serveIdentity(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	iw := identityWriters.Get().(*identityWriter)
+	iw.ResponseWriter = w
+	iw.wroteHeader = false
+	next.ServeHTTP(iw, r)
+	iw.ResponseWriter = nil
+	identityWriters.Put(iw)
+}
+
+func (iw *identityWriter) WriteHeader(statusCode int) {
+	if !iw.wroteHeader {
+		if identityEncoded(iw.Header()) {
+			iw.Header().Del("Content-Encoding")
+		}
+		// The informational responses are followed by the final one.
+		iw.wroteHeader = statusCode >= 200
+	}
+	iw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (iw *identityWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	return iw.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the io.ReaderFrom of the underlying writer, e.g. sendfile
+// of the files served by http.ServeContent.
+func (iw *identityWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := iw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(iw.ResponseWriter, src)
+}
+
+func (iw *identityWriter) Flush() {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (iw *identityWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := iw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Hijack keeps the identity responses upgradable, e.g. to WebSocket.
+func (iw *identityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := iw.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (iw *identityWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// close decides for the responses without body, and finishes the
+// compression.
+func (ew *encodingWriter) close() error {
+	if !ew.decided {
+		ew.decide(ew.buf, true)
+		if err := ew.writeBuffer(); err != nil {
+			return err
+		}
+	}
+	if !ew.compress {
+		if ew.cfg.stats {
+			countEncoding(Identity)
+		}
+		return nil
+	}
+	if ew.head {
+		if ew.cfg.stats {
+			countEncoding(ew.codec.encoding)
+		}
+		return nil
+	}
+
+	err := ew.out.err
+	if err == nil {
+		err = ew.encw.Close()
+	}
+	if !ew.cfg.noPooling {
+		ew.codec.putEncoder(ew.encw, ew.level)
+	}
+	ew.encw = nil
+	if err == nil && ew.capture != nil && !ew.capture.overflow {
+		ew.cfg.cache.store(ew.req, ew.cacheKey, ew.statusCode, ew.Header(), ew.capture.buf)
+	}
+	if ew.cfg.stats {
+		countEncoding(ew.codec.encoding)
+		countBytes(ew.in, ew.out.n)
+	}
+	if ew.cfg.compressionStats != nil {
+		ew.cfg.compressionStats(ew.req, CompressionStats{
+			Encoding:          ew.codec.encoding,
+			UncompressedBytes: ew.in,
+			CompressedBytes:   ew.out.n,
+		})
+	}
+	return err
+}
+
+// closeFailed reports the error err of close.
+func (ew *encodingWriter) closeFailed(err error) {
+	if !ew.compress || ew.out.err != nil || ew.req.Context().Err() != nil {
+		// The connection is gone, which is common and can't be helped.
+		ew.cfg.logger.Debugf("Error %v while finishing the response to %s, the connection is gone.", err, ew.req.URL)
+	} else {
+		ew.cfg.logger.Errorf("Error %v while finishing the %s encoded response to %s.", err, ew.codec.encoding, ew.req.URL)
+	}
+	if ew.cfg.closeErrorFunc != nil {
+		ew.cfg.closeErrorFunc(ew.req, err)
+	}
+}
+
+// Flush sends the written data to the client, e.g. for server-sent events.
+// The compression decision is made with the buffered data if it hasn't
+// been made yet.
+func (ew *encodingWriter) Flush() {
+	if !ew.decided {
+		if !ew.wroteHeader {
+			ew.wroteHeader = true
+			ew.statusCode = http.StatusOK
+		}
+		ew.decide(ew.buf, false)
+		if err := ew.writeBuffer(); err != nil {
+			return
+		}
+	}
+	if ew.compress && !ew.head {
+		ew.flush()
+		return
+	}
+	if f, ok := ew.httpw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Push pushes target by the underlying writer for HTTP/2 server push, it
+// returns http.ErrNotSupported if the underlying writer can't push.
+func (ew *encodingWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := ew.httpw.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+func (ew *encodingWriter) flush() error {
+	if err := ew.encw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := ew.httpw.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// encodeWrapper serves r by next, encoding the response by c.
+func encodeWrapper(next http.Handler, w http.ResponseWriter, r *http.Request, cfg *config, c *codec) {
+	deadline, ok := r.Context().Deadline()
+	if ok && deadline.Sub(timeNow()) < deadlineMargin {
+		// There is no time left for compressing, degrade to passthrough.
+		if cfg.stats {
+			countEncoding(Identity)
+		}
+		cfg.selected(r, c.encoding, false)
+		cfg.setVariant(w.Header())
+		serveIdentity(next, w, r)
+		return
+	}
+
+	var key string
+	if cfg.cache != nil && cacheableRequest(r) {
+		// The legacy name is a distinct variant.
+		key = cacheKey(r, cfg.contentCoding(c, r))
+		if e := cfg.cache.get(key); e != nil {
+			if cfg.stats {
+				countEncoding(c.encoding)
+			}
+			cfg.selected(r, c.encoding, true)
+			e.serve(w)
+			return
+		}
+	}
+
+	ew := newEncodingWriter(w, r, cfg, c)
+	ew.cacheKey = key
+	defer func() {
+		if err := ew.close(); err != nil {
+			ew.closeFailed(err)
+		}
+	}()
+	next.ServeHTTP(ew, r)
+}
+
+// newEncodingWriter returns the writer encoding the response to r by c.
+func newEncodingWriter(w http.ResponseWriter, r *http.Request, cfg *config, c *codec) *encodingWriter {
+	deadline, _ := r.Context().Deadline()
+	return &encodingWriter{
+		httpw:    w,
+		req:      r,
+		codec:    c,
+		coding:   cfg.contentCoding(c, r),
+		cfg:      cfg,
+		level:    cfg.requestLevel(c, r),
+		deadline: deadline,
+		head:     r.Method == http.MethodHead,
+	}
+}
+
+// Writer is the http.ResponseWriter EncodingHandler encodes the responses
+// with, for composing the encoding into other handlers. The encoding is
+// negotiated beforehand, e.g. by SelectEncoding.
+//
+// The headers set before the first Write, or WriteHeader, decide whether
+// the response is encoded, like they do for EncodingHandler, e.g. by
+// Content-Type, and so does the body buffered before the decision. Once
+// encoded, Content-Encoding and Vary are set and Content-Length is
+// removed. WriteHeader only passes the status once the decision is made.
+// Writer implements http.Flusher, and http.Pusher which returns
+// http.ErrNotSupported if w doesn't. Close must be called once the
+// response is written, to write the buffered body and finish the encoding.
+type Writer struct {
+	*encodingWriter
+}
+
+// NewWriter returns the Writer encoding the response to r by enc, which is
+// written to w. The options are applied like EncodingHandler, the ones of
+// the negotiation and the response cache don't apply.
+func NewWriter(w http.ResponseWriter, r *http.Request, enc EncodingType, opts ...Option) (*Writer, error) {
+	cfg := newConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	c, ok := cfg.codec(verifyEncodingName(string(enc)))
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %s", enc)
+	}
+	return &Writer{newEncodingWriter(w, r, cfg, c)}, nil
+}
+
+// Close writes the buffered body and finishes the encoding, the response
+// can't be written after it.
+func (w *Writer) Close() error {
+	return w.close()
+}
@@ -0,0 +1,1323 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestMaxBufferSize(t *testing.T) {
+	const maxBufferSize = 100
+	chunk := []byte("0123456789")
+	written := 0
+	chunkh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := w.(*encodingWriter)
+		for i := 0; i < 100; i++ {
+			w.Write(chunk)
+			written += len(chunk)
+			if len(gw.buf) > maxBufferSize {
+				t.Fatalf("The buffer should not be larger than %d, but is %d.", maxBufferSize, len(gw.buf))
+			}
+			if written >= maxBufferSize && !(gw.decided && gw.compress) {
+				t.Fatalf("The response should be compressed once %d bytes are written.", written)
+			}
+		}
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, chunkh, WithMaxBufferSize(maxBufferSize))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+	}
+	buf, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Unable to read body from reader due to error %v.", err)
+	}
+	if !bytes.Equal(buf, bytes.Repeat(chunk, 100)) {
+		t.Fatalf("The body should be the %d written bytes, but returned %d bytes.", written, len(buf))
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	untypedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>Hello, world.</body></html>"))
+	})
+	typedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>Hello, world.</body></html>"))
+	})
+	cases := []struct {
+		h          http.Handler
+		require    bool
+		compressed bool
+	}{
+		{untypedh, true, false},
+		{untypedh, false, true},
+		{typedh, true, true},
+	}
+	for _, c := range cases {
+		h, err := EncodingHandler([]EncodingType{GZip}, c.h, WithRequireContentType(c.require))
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if compressed := w.Header().Get("Content-Encoding") == string(GZip); compressed != c.compressed {
+			t.Fatalf("The response should be compressed: %v with Content-Type required: %v, but is %v.",
+				c.compressed, c.require, compressed)
+		}
+		if !c.compressed && w.Body.String() != "<html><body>Hello, world.</body></html>" {
+			t.Fatalf("The body should not be modified, but returned [%s].", w.Body.String())
+		}
+	}
+}
+
+func TestSniffSmallWrites(t *testing.T) {
+	// The PNG signature is split into two writes, it should still be
+	// sniffed as image/png.
+	pngh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG"))
+		w.Write([]byte("\x0D\x0A\x1A\x0A"))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, pngh, WithCompressibleTypes(nil))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("The sniffed Content-Type should be image/png, but is %q.", w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("A sniffed image/png should not be compressed, but Content-Encoding is %q.",
+			w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.String() != "\x89PNG\x0D\x0A\x1A\x0A" {
+		t.Fatalf("The body should be passed through, but returned %q.", w.Body.String())
+	}
+}
+
+func TestGZipHuffmanOnly(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithGzipLevel(gzip.HuffmanOnly))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid gzip level.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+	}
+	buf, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Unable to read body from reader due to error %v.", err)
+	}
+	if !bytes.Equal(buf, body) {
+		t.Fatalf("The body should be [%s], but returned [%s].", body, buf)
+	}
+}
+
+func TestGzipLevelFunc(t *testing.T) {
+	body := &bytes.Buffer{}
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(body, "line %d: %d\n", i, i*i%977)
+	}
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body.Bytes())
+	})
+	levelFunc := func(r *http.Request) int {
+		if r.Header.Get("X-Bulk") != "" {
+			return gzip.BestCompression
+		}
+		return gzip.BestSpeed
+	}
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithGzipLevelFunc(levelFunc))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	sizes := make(map[string]int)
+	// Serve twice, the pooled writers of different levels should not be mixed.
+	for i := 0; i < 2; i++ {
+		for _, bulk := range []string{"", "1"} {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", string(GZip))
+			r.Header.Set("X-Bulk", bulk)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if size, ok := sizes[bulk]; ok && size != w.Body.Len() {
+				t.Fatalf("The compressed size should be %d for the same level, but is %d.", size, w.Body.Len())
+			}
+			sizes[bulk] = w.Body.Len()
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+			}
+			buf, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("Unable to read body from reader due to error %v.", err)
+			}
+			if !bytes.Equal(buf, body.Bytes()) {
+				t.Fatalf("The decompressed body doesn't match the original one.")
+			}
+		}
+	}
+	if sizes[""] <= sizes["1"] {
+		t.Fatalf("The size of BestSpeed %d should be larger than BestCompression %d.", sizes[""], sizes["1"])
+	}
+}
+
+func TestEncodedByInnerHandler(t *testing.T) {
+	// The body is gzipped by the inner handler itself.
+	gzipped := &bytes.Buffer{}
+	gzipw := gzip.NewWriter(gzipped)
+	gzipw.Write([]byte("Hello, world."))
+	gzipw.Close()
+
+	encodedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		// The header is written before any body.
+		w.WriteHeader(http.StatusOK)
+		if !w.(*encodingWriter).decided {
+			t.Fatalf("The decision should be made at WriteHeader for an encoded response.")
+		}
+		w.Write(gzipped.Bytes())
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, encodedh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if ce := w.Header()["Content-Encoding"]; len(ce) != 1 || ce[0] != "gzip" {
+		t.Fatalf("Content-Encoding should be [gzip], but is %v.", ce)
+	}
+	if w.Header().Get("Content-Type") != "" {
+		t.Fatalf("The encoded body should not be sniffed, but Content-Type is %q.", w.Header().Get("Content-Type"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), gzipped.Bytes()) {
+		t.Fatalf("The encoded body should be passed through without encoding again.")
+	}
+}
+
+func TestEncodedByInnerHandlerOtherCoding(t *testing.T) {
+	// The inner handler serves a precompressed brotli file to a client
+	// accepting both, it isn't wrapped by gzip.
+	brh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("brotli data"))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, brh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", "gzip, br")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if ce := w.Header()["Content-Encoding"]; len(ce) != 1 || ce[0] != "br" {
+		t.Fatalf("Content-Encoding should be [br], but is %v.", ce)
+	}
+	if w.Body.String() != "brotli data" {
+		t.Fatalf("The encoded body should be passed through, but is %q.", w.Body.String())
+	}
+}
+
+func TestEncodedByInnerHandlerIdentity(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	for _, ce := range []string{"identity", " Identity "} {
+		identityh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", ce)
+			w.Write(body)
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, identityh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if values, ok := w.Header()["Content-Encoding"]; ok {
+			t.Fatalf("No Content-Encoding should be sent for %q, but is %v.", ce, values)
+		}
+		if !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("The body should be served uncompressed for %q.", ce)
+		}
+
+		// Nor if identity is negotiated, or the only one allowed.
+		identityOnly, err := EncodingHandler([]EncodingType{Identity}, identityh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		for _, h := range []http.Handler{h, identityOnly} {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", "br")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if values, ok := w.Header()["Content-Encoding"]; ok {
+				t.Fatalf("No Content-Encoding should be sent for %q with identity negotiated, but is %v.", ce, values)
+			}
+			if !bytes.Equal(w.Body.Bytes(), body) {
+				t.Fatalf("The body should be served as it is for %q with identity negotiated.", ce)
+			}
+		}
+	}
+}
+
+func TestResponseNoTransform(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	for _, cc := range []string{"no-transform", "public, No-Transform, max-age=60"} {
+		noTransformh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", cc)
+			w.Write(body)
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, noTransformh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Fatalf("No Content-Encoding should be set for Cache-Control %q, but is %q.", cc, ce)
+		}
+		if !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("The body should be served uncompressed for Cache-Control %q.", cc)
+		}
+	}
+}
+
+func TestIdentityHijack(t *testing.T) {
+	// The identity responses are passed through, they can be flushed and
+	// hijacked, e.g. for WebSocket.
+	hijackh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("The identity response should be flushable.")
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("The identity response should be hijacked, but returned %v.", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 9\r\nConnection: close\r\n\r\nHijacked.")
+		buf.Flush()
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, hijackh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+	r, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	r.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("The hijacked response should be read, but returned %v.", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "Hijacked." {
+		t.Fatalf("The body should be written to the hijacked connection, but is %q.", body)
+	}
+}
+
+func TestWriteHeaderAfterWrite(t *testing.T) {
+	for _, contentType := range []string{"", "text/plain"} {
+		ct := contentType
+		lateh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello, "))
+			if ct != "" {
+				// The Content-Type set after the first write doesn't
+				// change the buffered decision.
+				w.Header().Set("Content-Type", ct)
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("world."))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, lateh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusCreated {
+			t.Fatalf("Status %d should be returned, but returned %d.", http.StatusCreated, w.Result().StatusCode)
+		}
+		if w.Header().Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("Content-Encoding should be %s but %s was returned.",
+				GZip, w.Header().Get("Content-Encoding"))
+		}
+
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+		}
+		buf, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("Unable to read body from reader due to error %v.", err)
+		}
+		if string(buf) != "Hello, world." {
+			t.Fatalf("The body should be [%s], but returned [%s].", "Hello, world.", string(buf))
+		}
+	}
+}
+
+func TestStripContentLength(t *testing.T) {
+	lengthh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "13")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip, Identity}, lengthh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for _, enc := range []EncodingType{GZip, Identity} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(enc))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cl, ok := w.Header()["Content-Length"]
+		if enc == GZip && ok {
+			t.Fatalf("No Content-Length should be set for the compressed body, but is %v.", cl)
+		}
+		if enc == Identity && (len(cl) != 1 || cl[0] != "13") {
+			t.Fatalf("Content-Length should be kept for identity, but is %v.", cl)
+		}
+	}
+}
+
+func TestHTTP2NoTransferEncoding(t *testing.T) {
+	lengthh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "13")
+		// A handler written for HTTP/1.1 only.
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, lengthh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+	if te, ok := w.Header()["Transfer-Encoding"]; ok {
+		t.Fatalf("No Transfer-Encoding should be set for HTTP/2, but is %v.", te)
+	}
+	if cl, ok := w.Header()["Content-Length"]; ok {
+		t.Fatalf("No Content-Length should be set for the compressed body, but is %v.", cl)
+	}
+}
+
+func TestClearTransferCodings(t *testing.T) {
+	tecodedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Transfer-Encoding", "gzip, chunked")
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, tecodedh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("Content-Encoding should be %s but %s was returned.",
+			GZip, w.Header().Get("Content-Encoding"))
+	}
+	if te := w.Header()["Transfer-Encoding"]; len(te) != 1 || te[0] != "chunked" {
+		t.Fatalf("Transfer-Encoding should be [chunked], but is %v.", te)
+	}
+
+	cases := map[string]string{
+		"gzip":                "",
+		"chunked":             "chunked",
+		"x-gzip, Chunked":     "Chunked",
+		"deflate,br, chunked": "chunked",
+	}
+	for te, expected := range cases {
+		header := http.Header{"Transfer-Encoding": {te}}
+		clearTransferCodings(header)
+		if header.Get("Transfer-Encoding") != expected {
+			t.Fatalf("Transfer-Encoding %q should be cleared to %q, but is %q.", te, expected, header.Get("Transfer-Encoding"))
+		}
+	}
+}
+
+func TestMinSizeFunc(t *testing.T) {
+	minSize := func(contentType string) int {
+		if strings.HasPrefix(contentType, "text/html") {
+			return 10
+		}
+		return 1024
+	}
+	cases := []struct {
+		contentType string
+		body        []byte
+		compressed  bool
+	}{
+		{"text/html; charset=utf-8", []byte("<html><body>Hello</body></html>"), true},
+		{"application/json", []byte(`{"hello":"world"}`), false},
+		{"application/json", bytes.Repeat([]byte(`{"hello":"world"}`), 100), true},
+		// The sniffed Content-Type is used.
+		{"", []byte("<html><body>Hello</body></html>"), true},
+		{"", []byte("Hello, world."), false},
+	}
+	for _, c := range cases {
+		ct, body := c.contentType, c.body
+		typedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			// Write in small pieces.
+			for i := 0; i < len(body); i += 7 {
+				end := i + 7
+				if end > len(body) {
+					end = len(body)
+				}
+				w.Write(body[i:end])
+			}
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, typedh, WithMinSizeFunc(minSize))
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if !c.compressed {
+			if w.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("%d bytes of %q should not be compressed, but Content-Encoding is %q.",
+					len(body), ct, w.Header().Get("Content-Encoding"))
+			}
+			if !bytes.Equal(w.Body.Bytes(), body) {
+				t.Fatalf("The body should be [%s], but returned [%s].", body, w.Body.Bytes())
+			}
+			continue
+		}
+		if w.Header().Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("%d bytes of %q should be compressed, but Content-Encoding is %q.",
+				len(body), ct, w.Header().Get("Content-Encoding"))
+		}
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+		}
+		buf, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("Unable to read body from reader due to error %v.", err)
+		}
+		if !bytes.Equal(buf, body) {
+			t.Fatalf("The body should be [%s], but returned [%s].", body, buf)
+		}
+	}
+}
+
+func TestMinSize(t *testing.T) {
+	const minSize = 1024
+	for _, size := range []int{10, 100 << 10} {
+		for _, writeHeader := range []bool{false, true} {
+			body := bytes.Repeat([]byte("0123456789"), size/10)
+			sizedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				if writeHeader {
+					// The status is written before enough bytes are buffered.
+					w.WriteHeader(http.StatusCreated)
+				}
+				w.Write(body)
+			})
+			h, err := EncodingHandler([]EncodingType{GZip}, sizedh, WithMinSize(minSize))
+			if err != nil {
+				t.Fatalf("No error should be returned for a valid encoding.")
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			r.Header.Add("Accept-Encoding", string(GZip))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if writeHeader && w.Code != http.StatusCreated {
+				t.Fatalf("Status %d should be returned, but returned %d.", http.StatusCreated, w.Code)
+			}
+			if size < minSize {
+				if w.Header().Get("Content-Encoding") != "" {
+					t.Fatalf("%d bytes should not be compressed, but Content-Encoding is %q.",
+						size, w.Header().Get("Content-Encoding"))
+				}
+				if !bytes.Equal(w.Body.Bytes(), body) {
+					t.Fatalf("The body should be [%s], but returned [%s].", body, w.Body.Bytes())
+				}
+				continue
+			}
+			if w.Header().Get("Content-Encoding") != string(GZip) {
+				t.Fatalf("%d bytes should be compressed, but Content-Encoding is %q.",
+					size, w.Header().Get("Content-Encoding"))
+			}
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+			}
+			buf, err := ioutil.ReadAll(gr)
+			if err != nil || !bytes.Equal(buf, body) {
+				t.Fatalf("The body should be decompressed to the original %d bytes, but got %d bytes, %v.", size, len(buf), err)
+			}
+		}
+	}
+	if err := WithMinSize(-1)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for a negative min size.")
+	}
+}
+
+// failingWriter fails the writes after limit bytes are written.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+	// writes counts the calls of Write after it fails.
+	writes int
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	if f.Body.Len()+len(b) > f.limit {
+		f.writes++
+		return 0, errBrokenPipe
+	}
+	return f.ResponseRecorder.Write(b)
+}
+
+func TestUnderlyingWriteError(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	chunk := make([]byte, 1024)
+	var writeErr error
+	written := 0
+	randomh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 1024; i++ {
+			// Random data can't be compressed, the compressor emits
+			// about as much as it's passed.
+			rnd.Read(chunk)
+			if _, writeErr = w.Write(chunk); writeErr != nil {
+				return
+			}
+			written += len(chunk)
+		}
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, randomh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: 64 << 10}
+	h.ServeHTTP(w, r)
+
+	if !errors.Is(writeErr, errBrokenPipe) {
+		t.Fatalf("The error %v of the underlying writer should be returned, but returned %v.", errBrokenPipe, writeErr)
+	}
+	if written >= 1024*len(chunk) {
+		t.Fatalf("The inner handler should abort after the error.")
+	}
+	if w.writes != 1 {
+		t.Fatalf("The underlying writer should not be written after the error, but is written %d times.", w.writes)
+	}
+}
+
+// failingCloser fails to close.
+type failingCloser struct {
+	io.Writer
+}
+
+var errClose = errors.New("close failed")
+
+func (f failingCloser) Close() error {
+	return errClose
+}
+
+func TestCloseError(t *testing.T) {
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+
+	// The gzip header is written, and the connection is gone before the
+	// compressed data is written by close.
+	logger := &fakeLogger{}
+	var closeErr error
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithLogger(logger),
+		WithCloseErrorFunc(func(r *http.Request, err error) { closeErr = err }))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	h.ServeHTTP(&failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: 10}, r)
+	if !errors.Is(closeErr, errBrokenPipe) {
+		t.Fatalf("The error %v should be reported, but reported %v.", errBrokenPipe, closeErr)
+	}
+	if !logger.logged("DEBUG", "broken pipe") || logger.logged("ERROR", "") {
+		t.Fatalf("The error should be logged at debug level for a gone connection, but logged %v.", logger.messages)
+	}
+
+	// The encoder fails to close.
+	logger = &fakeLogger{}
+	closeErr = nil
+	factory := func(w io.Writer) (io.WriteCloser, error) {
+		return failingCloser{w}, nil
+	}
+	h, err = EncodingHandler([]EncodingType{GZip}, bodyh, WithLogger(logger), WithEncoderFactory(GZip, factory),
+		WithCloseErrorFunc(func(r *http.Request, err error) { closeErr = err }))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !errors.Is(closeErr, errClose) {
+		t.Fatalf("The error %v should be reported, but reported %v.", errClose, closeErr)
+	}
+	if !logger.logged("ERROR", "close failed") {
+		t.Fatalf("The error should be logged, but logged %v.", logger.messages)
+	}
+
+	if err := WithCloseErrorFunc(nil)(newConfig()); err == nil {
+		t.Fatalf("An error should be returned for a nil close error func.")
+	}
+}
+
+// headerCountingWriter counts the calls of WriteHeader.
+type headerCountingWriter struct {
+	*httptest.ResponseRecorder
+	writeHeaders int
+}
+
+func (h *headerCountingWriter) WriteHeader(statusCode int) {
+	h.writeHeaders++
+	h.ResponseRecorder.WriteHeader(statusCode)
+}
+
+func TestDoubleWriteHeader(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	cases := map[string]struct {
+		h      http.HandlerFunc
+		status int
+	}{
+		"before write": {func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body)
+		}, http.StatusCreated},
+		"after write": {func(w http.ResponseWriter, r *http.Request) {
+			// The body is enough for the decision, 200 is written with it.
+			w.Write(body)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body)
+		}, http.StatusOK},
+		"after buffered write": {func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello, "))
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body)
+		}, http.StatusCreated},
+	}
+	for name, c := range cases {
+		h, err := EncodingHandler([]EncodingType{GZip}, c.h)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := &headerCountingWriter{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, r)
+		if w.Code != c.status || w.writeHeaders != 1 {
+			t.Fatalf("Status %d should be written once %s, but %d is written %d times.",
+				c.status, name, w.Code, w.writeHeaders)
+		}
+		if w.Header().Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("Content-Encoding should be %s %s, but is %q.", GZip, name, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestWriteCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var writeErr error
+	writes := 0
+	streamh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		chunk := bytes.Repeat([]byte("Hello, world."), 1000)
+		for i := 0; i < 100; i++ {
+			if _, writeErr = w.Write(chunk); writeErr != nil {
+				return
+			}
+			writes++
+			if i == 0 {
+				// The client disconnects.
+				cancel()
+			}
+		}
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, streamh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil).WithContext(ctx)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if writeErr != context.Canceled || writes != 1 {
+		t.Fatalf("The write should fail with %v after the cancellation, but returned %v after %d writes.",
+			context.Canceled, writeErr, writes)
+	}
+}
+
+func TestHead(t *testing.T) {
+	content := bytes.Repeat([]byte("Hello, world."), 100)
+	handlers := map[string]http.HandlerFunc{
+		// http.ServeContent writes no body for HEAD.
+		"ServeContent": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+		},
+		// The body written for HEAD is discarded.
+		"Write": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(content)
+		},
+	}
+	for name, inner := range handlers {
+		h, err := EncodingHandler([]EncodingType{GZip}, inner)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodHead, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("HEAD should be negotiated as GET by %s, but status is %d and Content-Encoding is %q.",
+				name, w.Code, w.Header().Get("Content-Encoding"))
+		}
+		if w.Header().Get("Content-Length") != "" {
+			t.Fatalf("The length of the identity body should be removed by %s, but is %q.", name, w.Header().Get("Content-Length"))
+		}
+		if w.Body.Len() != 0 {
+			t.Fatalf("No body should be written for HEAD by %s, but %d bytes are written.", name, w.Body.Len())
+		}
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	small := []byte("Hello, world.")
+	large := bytes.Repeat(small, 100)
+	handlers := map[string]func(body []byte) http.HandlerFunc{
+		// The body written for HEAD is discarded.
+		"Write": func(body []byte) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(body)
+			}
+		},
+		// Only the length of the body is set for HEAD.
+		"Content-Length": func(body []byte) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				if r.Method != http.MethodHead {
+					w.Write(body)
+				}
+			}
+		},
+	}
+	for name, handler := range handlers {
+		for _, body := range [][]byte{nil, small, large} {
+			h, err := EncodingHandler([]EncodingType{GZip}, handler(body), WithMinSize(100))
+			if err != nil {
+				t.Fatalf("No error should be returned for a valid encoding.")
+			}
+			ce := map[string]string{}
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				r := httptest.NewRequest(method, "http://localhost", nil)
+				r.Header.Add("Accept-Encoding", string(GZip))
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				ce[method] = w.Header().Get("Content-Encoding")
+			}
+			if ce[http.MethodHead] != ce[http.MethodGet] {
+				t.Fatalf("Content-Encoding of HEAD should be %q as GET for %d bytes by %s, but is %q.",
+					ce[http.MethodGet], len(body), name, ce[http.MethodHead])
+			}
+		}
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	rec := httptest.NewRecorder()
+	w, err := NewWriter(rec, r, XGZip, WithGzipLevel(gzip.BestSpeed))
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding, but returned %v.", err)
+	}
+	var _ http.ResponseWriter = w
+	var _ http.Flusher = w
+	var _ http.Pusher = w
+	var _ io.StringWriter = w
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		t.Fatalf("No error should be returned by Close, but returned %v.", err)
+	}
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("The response should be encoded with status %d, but status is %d and Content-Encoding is %q.",
+			http.StatusCreated, rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Unable to construct a new gzip reader due to error %v.", err)
+	}
+	if decoded, err := ioutil.ReadAll(gr); err != nil || !bytes.Equal(decoded, body) {
+		t.Fatalf("The body should be decoded to the original one, but the error is %v.", err)
+	}
+
+	for _, enc := range []EncodingType{"fdsafdsa", Identity, EXI} {
+		if _, err := NewWriter(httptest.NewRecorder(), r, enc); err == nil {
+			t.Fatalf("An error should be returned for encoding %s.", enc)
+		}
+	}
+	if _, err := NewWriter(httptest.NewRecorder(), r, GZip, WithGzipLevel(100)); err == nil {
+		t.Fatalf("An error should be returned for an invalid option.")
+	}
+}
+
+func TestInvalidLevel(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	for _, noPooling := range []bool{false, true} {
+		logger := &fakeLogger{}
+		cfg := newConfig()
+		cfg.logger = logger
+		cfg.noPooling = noPooling
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		w := httptest.NewRecorder()
+		ew := newEncodingWriter(w, r, cfg, gzipCodec)
+		// The level is validated by the options, it's injected here.
+		ew.level = gzip.BestCompression + 1
+		ew.Header().Set("Content-Type", "text/plain")
+		ew.Write(body)
+		if err := ew.close(); err != nil {
+			t.Fatalf("No error should be returned by close, but returned %v.", err)
+		}
+		if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("The response should fall back to identity, but Content-Encoding is %q.", w.Header().Get("Content-Encoding"))
+		}
+		if !logger.logged("ERROR", "gzip encoder") {
+			t.Fatalf("The error should be logged, but logged %v.", logger.messages)
+		}
+	}
+}
+
+func TestStackedEncoding(t *testing.T) {
+	// The br body is opaque to the test, it's passed through.
+	brotli := []byte("brotli encoded body")
+	encodedh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(brotli)
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, encodedh, WithStackedEncoding())
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if ce := w.Header()["Content-Encoding"]; len(ce) != 1 || ce[0] != "br, gzip" {
+		t.Fatalf("Content-Encoding should be [br, gzip], but is %v.", ce)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("The response should be a valid gzip stream, %v.", err)
+	}
+	body, err := ioutil.ReadAll(gr)
+	if err != nil || !bytes.Equal(body, brotli) {
+		t.Fatalf("The gzip layer should be decompressed to the br body, got %q, %v.", body, err)
+	}
+}
+
+func TestWithoutPooling(t *testing.T) {
+	var writers []*gzip.Writer
+	gzipwh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Hello, world."))
+		writers = append(writers, w.(*encodingWriter).encw.(*gzip.Writer))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, gzipwh, WithoutPooling())
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != string(GZip) {
+			t.Fatalf("The response should be compressed.")
+		}
+	}
+	for i, gzipw := range writers {
+		if gzipw == nil {
+			t.Fatalf("The response %d should have a gzip writer.", i)
+		}
+		for _, other := range writers[:i] {
+			if gzipw == other {
+				t.Fatalf("Each response should get a distinct gzip writer without pooling.")
+			}
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	chunks := []string{"data: hello\n\n", "data: world\n\n"}
+	read := make(chan struct{})
+	eventsh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			// The next chunk is written after the client has read this one.
+			select {
+			case <-read:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	})
+	for _, enc := range []EncodingType{GZip, BR, ZStd} {
+		h, err := EncodingHandler([]EncodingType{enc}, eventsh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		server := httptest.NewServer(h)
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Accept-Encoding", string(enc))
+		resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatalf("The request should succeed, but returned %v.", err)
+		}
+		if resp.Header.Get("Content-Encoding") != string(enc) {
+			t.Fatalf("Content-Encoding should be %s but %s was returned.", enc, resp.Header.Get("Content-Encoding"))
+		}
+		var body io.Reader
+		switch enc {
+		case GZip:
+			body, err = gzip.NewReader(resp.Body)
+		case BR:
+			body = brotli.NewReader(resp.Body)
+		case ZStd:
+			var zr *zstd.Decoder
+			zr, err = zstd.NewReader(resp.Body)
+			defer zr.Close()
+			body = zr
+		}
+		if err != nil {
+			t.Fatalf("Unable to construct a new %s reader due to error %v.", enc, err)
+		}
+		for _, chunk := range chunks {
+			buf := make([]byte, len(chunk))
+			if _, err := io.ReadFull(body, buf); err != nil || string(buf) != chunk {
+				t.Fatalf("The flushed chunk [%s] should be readable, but got [%s], %v.", chunk, buf, err)
+			}
+			read <- struct{}{}
+		}
+		resp.Body.Close()
+		server.Close()
+	}
+}
+
+// pushRecorder is a ResponseRecorder which records the pushed targets.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
+}
+
+func TestPush(t *testing.T) {
+	var pushErr error
+	pushh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pusher, ok := w.(http.Pusher)
+		if !ok {
+			t.Fatalf("The writer should implement http.Pusher.")
+		}
+		pushErr = pusher.Push("/style.css", nil)
+		w.Write([]byte("Hello, world."))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, pushh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, r)
+	if pushErr != nil || len(w.pushed) != 1 || w.pushed[0] != "/style.css" {
+		t.Fatalf("/style.css should be pushed, but pushed %v with error %v.", w.pushed, pushErr)
+	}
+
+	// The underlying writer can't push.
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if pushErr != http.ErrNotSupported {
+		t.Fatalf("%v should be returned if the underlying writer can't push, but returned %v.", http.ErrNotSupported, pushErr)
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	emptyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, opts := range [][]Option{nil, {WithMinSize(0)}} {
+		h, err := EncodingHandler([]EncodingType{GZip}, emptyh, opts...)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Status %d should be returned, but returned %d.", http.StatusOK, w.Code)
+		}
+		if ce, ok := w.Header()["Content-Encoding"]; ok {
+			t.Fatalf("No Content-Encoding should be set for the empty body, but is %v.", ce)
+		}
+		if w.Body.Len() != 0 {
+			t.Fatalf("The body should be empty, but is %d bytes.", w.Body.Len())
+		}
+	}
+}
+
+func TestBodilessStatus(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		code := status
+		bodilessh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(code)
+		})
+		h, err := EncodingHandler([]EncodingType{GZip}, bodilessh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(GZip))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Fatalf("Status %d should be returned, but returned %d.", code, w.Code)
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Fatalf("No Content-Encoding should be set for %d, but is %q.", code, ce)
+		}
+		if w.Body.Len() != 0 {
+			t.Fatalf("The body of %d should be empty, but is %d bytes.", code, w.Body.Len())
+		}
+	}
+}
+
+func TestInformationalStatus(t *testing.T) {
+	earlyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusEarlyHints)
+		if w.(*encodingWriter).decided {
+			t.Fatalf("The decision should not be made by an informational response.")
+		}
+		w.Write(bytes.Repeat([]byte("Hello, world."), 100))
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, earlyh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Add("Accept-Encoding", string(GZip))
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("The request should succeed, but returned %v.", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status %d should be returned, but returned %d.", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("The final response should be encoded, but Content-Encoding is %q.", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello, world."), 100)
+	trailerh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Declared")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+		w.Header().Set("X-Declared", "declared")
+		w.Header().Set(http.TrailerPrefix+"X-Prefixed", "prefixed")
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, trailerh)
+	if err != nil {
+		t.Fatalf("No error should be returned for a valid encoding.")
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Add("Accept-Encoding", string(GZip))
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("The request should succeed, but returned %v.", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != string(GZip) {
+		t.Fatalf("The response should be encoded, but Content-Encoding is %q.", resp.Header.Get("Content-Encoding"))
+	}
+	gzipr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("The body should be gzip, but returned %v.", err)
+	}
+	decoded, err := io.ReadAll(gzipr)
+	if err != nil || !bytes.Equal(decoded, body) {
+		t.Fatalf("The body should be decoded, but returned %v.", err)
+	}
+	// The trailers are read at the end of the body.
+	io.Copy(io.Discard, resp.Body)
+	if v := resp.Trailer.Get("X-Declared"); v != "declared" {
+		t.Fatalf("The declared trailer should be sent, but is %q.", v)
+	}
+	if v := resp.Trailer.Get("X-Prefixed"); v != "prefixed" {
+		t.Fatalf("The prefixed trailer should be sent, but is %q.", v)
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	for _, enc := range []EncodingType{GZip, Identity} {
+		stringh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			for i := 0; i < 100; i++ {
+				if n, err := io.WriteString(w, "Hello, world."); n != 13 || err != nil {
+					t.Fatalf("WriteString should write 13 bytes, but wrote %d and returned %v.", n, err)
+				}
+			}
+			// It's longer than the buffer reused by WriteString.
+			io.WriteString(w, strings.Repeat("Hello, world.", 100))
+		})
+		h, err := EncodingHandler([]EncodingType{GZip, Identity}, stringh)
+		if err != nil {
+			t.Fatalf("No error should be returned for a valid encoding.")
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.Header.Add("Accept-Encoding", string(enc))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		body := w.Body.Bytes()
+		if enc == GZip {
+			gzipr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("The body should be gzip, but returned %v.", err)
+			}
+			body, _ = io.ReadAll(gzipr)
+		}
+		if string(body) != strings.Repeat("Hello, world.", 200) {
+			t.Fatalf("The strings should be written in order for %s, but the body is %q.", enc, body)
+		}
+	}
+}
+
+func benchmarkWriteString(b *testing.B, compressed, writeString bool) {
+	s := strings.Repeat("Hello, world.", 10)
+	contentType := "image/png"
+	if compressed {
+		contentType = "text/plain"
+	}
+	bodyh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		for i := 0; i < 100; i++ {
+			if writeString {
+				io.WriteString(w, s)
+			} else {
+				w.Write([]byte(s))
+			}
+		}
+	})
+	h, err := EncodingHandler([]EncodingType{GZip}, bodyh, WithCompressibleTypes(nil))
+	if err != nil {
+		b.Fatalf("No error should be returned for a valid encoding.")
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	r.Header.Add("Accept-Encoding", string(GZip))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func BenchmarkWriteBytesUncompressed(b *testing.B)  { benchmarkWriteString(b, false, false) }
+func BenchmarkWriteStringUncompressed(b *testing.B) { benchmarkWriteString(b, false, true) }
+func BenchmarkWriteBytesGzip(b *testing.B)          { benchmarkWriteString(b, true, false) }
+func BenchmarkWriteStringGzip(b *testing.B)         { benchmarkWriteString(b, true, true) }